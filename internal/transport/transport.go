@@ -0,0 +1,185 @@
+// Package transport provides the HTTP transport shared by the clients of the Equinix Metal APIs.
+// It limits the rate of requests with a token bucket, and retries the requests that fail with
+// a transient error, with exponential backoff, or after the delay that the API asks for.
+package transport
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+// Config configures the rate limit and retries of a Transport
+type Config struct {
+	// RateLimit is the number of requests per second, with bursts of up to RateBurst, 0 for no limit
+	RateLimit float64
+	RateBurst int
+	// MaxRetries is how many times a request is retried after it failed
+	MaxRetries int
+	// MinBackoff is the delay before the first retry, doubled for each one after, up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Transport is an http.RoundTripper that limits the rate of requests, and retries them.
+// Requests that were rejected with 429 Too Many Requests are retried whatever their method,
+// as they were not processed, while those that failed otherwise, with a connection error or a
+// 502, 503 or 504 status, are retried only if they are idempotent. A Retry-After header is
+// honoured; if it asks for a longer delay than MaxBackoff, the response is returned as is.
+type Transport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+	config  Config
+	// sleep is overridden in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// New returns a Transport that sends the requests with base, or http.DefaultTransport if nil
+func New(base http.RoundTripper, config Config) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &Transport{
+		base:   base,
+		config: config,
+		sleep:  sleep,
+	}
+	if config.RateLimit > 0 {
+		t.limiter = rate.NewLimiter(rate.Limit(config.RateLimit), max(config.RateBurst, 1))
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if t.limiter != nil {
+			if err := t.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		r := req
+		if attempt > 0 {
+			var err error
+			if r, err = rewind(req); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		if attempt >= t.config.MaxRetries || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp, time.Now()); ok {
+				if after > t.config.MaxBackoff {
+					return resp, err
+				}
+				delay = after
+			}
+			// the body must be read and closed for the connection to be reused
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		klog.V(2).Infof("retrying %s %s in %s, attempt %d: %s", req.Method, req.URL.Redacted(), delay, attempt+1, failure(resp, err))
+		if err := t.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backoff returns the delay before the retry after the attempt, with jitter of up to half of it
+func (t *Transport) backoff(attempt int) time.Duration {
+	delay := t.config.MinBackoff
+	for i := 0; i < attempt && delay < t.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, t.config.MaxBackoff)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryable returns true if the request may be retried after the response or error
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// the body cannot be sent again
+		return false
+	}
+	if err != nil {
+		return idempotent(req.Method) && req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(req.Method)
+	default:
+		return false
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter returns the delay of the Retry-After header of a response, in seconds or as a date
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0), true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// rewind returns a copy of the request with a fresh body, to send it again
+func rewind(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	return r, nil
+}
+
+func failure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		statuses   []int
+		retryAfter string
+		status     int
+		attempts   int
+	}{
+		{"success", http.MethodGet, []int{200}, "", 200, 1},
+		{"unavailable get", http.MethodGet, []int{503, 503, 200}, "", 200, 3},
+		{"unavailable post", http.MethodPost, []int{503, 200}, "", 503, 1},
+		{"too many requests post", http.MethodPost, []int{429, 200}, "", 200, 2},
+		{"retries exhausted", http.MethodGet, []int{503, 503, 503, 503, 200}, "", 503, 4},
+		{"retry after", http.MethodDelete, []int{429, 200}, "1", 200, 2},
+		{"retry after too long", http.MethodGet, []int{429, 200}, "120", 429, 1},
+		{"not found", http.MethodGet, []int{404, 200}, "", 404, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				attempts int
+				bodies   []string
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.statuses[attempts])
+				attempts++
+			}))
+			defer server.Close()
+
+			var delays []time.Duration
+			tr := New(nil, Config{RateLimit: 100, RateBurst: 10, MaxRetries: 3, MinBackoff: time.Second, MaxBackoff: time.Minute})
+			tr.sleep = func(_ context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				return nil
+			}
+			client := &http.Client{Transport: tr}
+
+			req, err := http.NewRequest(tt.method, server.URL, strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("mismatched status, actual %d expected %d", resp.StatusCode, tt.status)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("mismatched attempts, actual %d expected %d", attempts, tt.attempts)
+			}
+			for i, body := range bodies {
+				if body != "body" {
+					t.Errorf("mismatched body of attempt %d, actual %q", i, body)
+				}
+			}
+			if tt.retryAfter == "1" && (len(delays) != 1 || delays[0] != time.Second) {
+				t.Errorf("mismatched delays, actual %v expected [1s]", delays)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tr := New(nil, Config{MinBackoff: time.Second, MaxBackoff: 10 * time.Second})
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{0, 500 * time.Millisecond, time.Second},
+		{1, time.Second, 2 * time.Second},
+		{2, 2 * time.Second, 4 * time.Second},
+		{5, 5 * time.Second, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if delay := tr.backoff(tt.attempt); delay < tt.min || delay > tt.max {
+			t.Errorf("%d: backoff %s out of range %s to %s", tt.attempt, delay, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		delay  time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-5", 0, true},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{"soon", 0, false},
+	}
+
+	for i, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		delay, ok := retryAfter(resp, now)
+		if delay != tt.delay || ok != tt.ok {
+			t.Errorf("%d: mismatched retry after %q, actual %s %t expected %s %t", i, tt.header, delay, ok, tt.delay, tt.ok)
+		}
+	}
+}
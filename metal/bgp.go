@@ -2,30 +2,39 @@ package metal
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strings"
 
 	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 )
 
+const (
+	// bgpDeploymentTypeLocal lets nodes announce IPs of their own metro only
+	bgpDeploymentTypeLocal = "local"
+	// bgpDeploymentTypeGlobal lets nodes also announce global IPs, anycast from every metro
+	bgpDeploymentTypeGlobal = "global"
+)
+
 type bgp struct {
-	project   string
-	client    *metal.BGPApiService
-	k8sclient kubernetes.Interface
-	localASN  int
-	bgpPass   string
+	project        string
+	client         *metal.BGPApiService
+	k8sclient      kubernetes.Interface
+	localASN       int
+	bgpPass        string
+	deploymentType string
 }
 
 func newBGP(client *metal.BGPApiService, k8sclient kubernetes.Interface, metalConfig Config) (*bgp, error) {
 	b := &bgp{
-		client:    client,
-		k8sclient: k8sclient,
-		project:   metalConfig.ProjectID,
-		localASN:  metalConfig.LocalASN,
-		bgpPass:   metalConfig.BGPPass,
+		client:         client,
+		k8sclient:      k8sclient,
+		project:        metalConfig.ProjectID,
+		localASN:       metalConfig.LocalASN,
+		bgpPass:        metalConfig.BGPPass,
+		deploymentType: metalConfig.BGPDeploymentType,
 	}
 	// enable BGP
 	klog.V(2).Info("bgp.init(): enabling BGP on project")
@@ -53,6 +62,10 @@ func (b *bgp) enableBGP() error {
 	if err == nil && bgpConfig != nil && bgpConfig.GetId() != "" && bgpConfig.GetStatus() != metal.BGPCONFIGSTATUS_DISABLED {
 		b.localASN = int(bgpConfig.GetAsn())
 		b.bgpPass = bgpConfig.GetMd5()
+		// the deployment type of an existing config cannot be changed through the API
+		if deploymentType := string(bgpConfig.GetDeploymentType()); deploymentType != "" && deploymentType != b.deploymentType {
+			klog.Warningf("BGP is enabled on project %s with deployment type %s, not %s; global IPs are only announced with a global deployment", b.project, deploymentType, b.deploymentType)
+		}
 		return nil
 	}
 
@@ -60,7 +73,7 @@ func (b *bgp) enableBGP() error {
 	req := metal.BgpConfigRequestInput{
 		Asn:            int64(b.localASN),
 		Md5:            &b.bgpPass,
-		DeploymentType: "local",
+		DeploymentType: metal.BgpConfigRequestInputDeploymentType(b.deploymentType),
 		UseCase:        metal.PtrString("kubernetes-load-balancer"),
 	}
 	_, err = b.client.
@@ -70,16 +83,20 @@ func (b *bgp) enableBGP() error {
 	return err
 }
 
-// ensureNodeBGPEnabled check if the node has bgp enabled, and set it if it does not
-func ensureNodeBGPEnabled(id string, client *metal.APIClient) error {
+// ensureNodeBGPEnabled check if the node has bgp enabled for the IP family, and set it if it does not
+func ensureNodeBGPEnabled(id string, client *metal.APIClient, family v1.IPFamily) error {
 	// if we are rnning ccm properly, then the provider ID will be on the node object
 	id, err := deviceIDFromProviderID(id)
 	if err != nil {
 		return err
 	}
 	// fortunately, this is idempotent, so just create
+	addressFamily := metal.BGPSESSIONINPUTADDRESSFAMILY_IPV4
+	if family == v1.IPv6Protocol {
+		addressFamily = metal.BGPSESSIONINPUTADDRESSFAMILY_IPV6
+	}
 	req := metal.BGPSessionInput{
-		AddressFamily: metal.BGPSESSIONINPUTADDRESSFAMILY_IPV4.Ptr(),
+		AddressFamily: addressFamily.Ptr(),
 	}
 	_, response, err := client.DevicesApi.
 		CreateBgpSession(context.Background(), id).
@@ -88,14 +105,17 @@ func ensureNodeBGPEnabled(id string, client *metal.APIClient) error {
 
 	// if we already had one, then we can ignore the error
 	// this really should be a 409, but 422 is what is returned
-	if response.StatusCode == 422 && strings.Contains(fmt.Sprintf("%s", err), "already has session") {
+	if response != nil && response.StatusCode == 422 && strings.Contains(fmt.Sprintf("%s", err), "already has session") {
 		err = nil
 	}
+	if err != nil {
+		bgpSessionFailures.Inc()
+	}
 	return err
 }
 
-// getNodeBGPConfig get the BGP config for a specific node
-func getNodeBGPConfig(providerID string, client *metal.APIClient) (peer *metal.BgpNeighborData, err error) {
+// getNodeBGPConfig get the BGP config for a specific node and IP family
+func getNodeBGPConfig(providerID string, client *metal.APIClient, family v1.IPFamily) (peer *metal.BgpNeighborData, err error) {
 	id, err := deviceIDFromProviderID(providerID)
 	if err != nil {
 		return nil, err
@@ -108,11 +128,12 @@ func getNodeBGPConfig(providerID string, client *metal.APIClient) (peer *metal.B
 	}
 
 	bgpNeighbours := bgpSessions.GetBgpNeighbors()
-	// we need the ipv4 neighbour
+	// we need the neighbour of the family
+	addressFamily := ipFamilyVersion(family)
 	for _, n := range bgpNeighbours {
-		if n.GetAddressFamily() == 4 {
+		if n.GetAddressFamily() == addressFamily {
 			return &n, nil
 		}
 	}
-	return nil, errors.New("no matching ipv4 neighbour found")
+	return nil, fmt.Errorf("no matching %s neighbour found", strings.ToLower(string(family)))
 }
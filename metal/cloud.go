@@ -1,14 +1,24 @@
 package metal
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"time"
 
 	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/component-base/version"
 	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-provider-equinix-metal/internal/transport"
 )
 
 const (
@@ -23,6 +33,9 @@ const (
 
 	// checkLoopTimerSeconds how often to resync the kubernetes informers, in seconds
 	checkLoopTimerSeconds = 60
+
+	// maxAPIRetryBackoff is the longest delay before retrying a request to the Equinix Metal APIs
+	maxAPIRetryBackoff = 30 * time.Second
 )
 
 // cloud implements cloudprovider.Interface
@@ -33,6 +46,9 @@ type cloud struct {
 	loadBalancer                    *loadBalancers
 	controlPlaneEndpointManager     *controlPlaneEndpointManager
 	controlPlaneLoadBalancerManager *controlPlaneLoadBalancerManager
+	spotTerminationManager          *spotTerminationManager
+	deviceStateManager              *deviceStateManager
+	routes                          *routes
 	// holds our bgp service handler
 	bgp *bgp
 }
@@ -58,11 +74,27 @@ func init() {
 		// report the config to startup logs
 		printMetalConfig(metalConfig)
 
+		// expose the metrics of the provider on the metrics endpoint of the CCM
+		registerMetrics()
+
 		// set up our client and create the cloud interface
 		configuration := metal.NewConfiguration()
 		configuration.AddDefaultHeader("X-Auth-Token", metalConfig.AuthToken)
 		configuration.UserAgent = fmt.Sprintf("cloud-provider-equinix-metal/%s %s", version.Get(), configuration.UserAgent)
 		configuration.Debug = checkDebugEnabled()
+		if metalConfig.BaseURL != nil {
+			configuration.Servers = metal.ServerConfigurations{{URL: *metalConfig.BaseURL}}
+		}
+		// the transport is shared by all the clients of the Equinix Metal APIs, so that they are limited together
+		transportConfig, err := apiTransportConfig(metalConfig)
+		if err != nil {
+			return nil, fmt.Errorf("provider config error: %w", err)
+		}
+		base, err := apiHTTPTransport(metalConfig.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("provider config error: %w", err)
+		}
+		configuration.HTTPClient = &http.Client{Transport: transport.New(instrumentedTransport{base: base}, transportConfig)}
 		client := metal.NewAPIClient(configuration)
 		cloud, err := newCloud(metalConfig, client)
 		if err != nil {
@@ -80,7 +112,15 @@ func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder,
 	klog.V(5).Info("called Initialize")
 	clientset := clientBuilder.ClientOrDie("cloud-provider-equinix-metal-shared-informers")
 	// initialize the individual services
-	epm, err := newControlPlaneEndpointManager(clientset, stop, c.config.EIPTag, c.config.ProjectID, c.client, c.config.APIServerPort, c.config.EIPHealthCheckUseHostIP)
+	devices, err := newDeviceCache(c.client.DevicesApi, c.config)
+	if err != nil {
+		klog.Fatalf("could not initialize device cache: %v", err)
+	}
+	go devices.run(stop)
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ConsumerToken})
+	epm, err := newControlPlaneEndpointManager(clientset, recorder, stop, c.config.EIPTag, c.config.ProjectID, c.client, c.config.APIServerPort, c.config.EIPHealthCheckUseHostIP)
 	if err != nil {
 		klog.Fatalf("could not initialize ControlPlaneEndpointManager: %v", err)
 	}
@@ -88,20 +128,51 @@ func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder,
 	if err != nil {
 		klog.Fatalf("could not initialize ControlPlaneEndpointManager: %v", err)
 	}
+	spotLeadTime, err := parseDuration(c.config.SpotTerminationLeadTime, DefaultSpotTerminationLeadTime)
+	if err != nil {
+		klog.Fatalf("could not parse spot termination lead time: %v", err)
+	}
+	stm, err := newSpotTerminationManager(clientset, stop, devices, recorder, spotLeadTime)
+	if err != nil {
+		klog.Fatalf("could not initialize SpotTerminationManager: %v", err)
+	}
+	dsm, err := newDeviceStateManager(clientset, stop, devices)
+	if err != nil {
+		klog.Fatalf("could not initialize DeviceStateManager: %v", err)
+	}
 	bgp, err := newBGP(c.client.BGPApi, clientset, c.config)
 	if err != nil {
 		klog.Fatalf("could not initialize BGP: %v", err)
 	}
-	lb, err := newLoadBalancers(c.client, clientset, c.config.AuthToken, c.config.ProjectID, c.config.Metro, c.config.Facility, c.config.LoadBalancerSetting, bgp.localASN, bgp.bgpPass, c.config.AnnotationNetworkIPv4Private, c.config.AnnotationLocalASN, c.config.AnnotationPeerASN, c.config.AnnotationPeerIP, c.config.AnnotationSrcIP, c.config.AnnotationBGPPass, c.config.AnnotationEIPMetro, c.config.AnnotationEIPFacility, c.config.BGPNodeSelector, c.config.EIPTag)
+	instances, err := newInstances(devices, c.config)
+	if err != nil {
+		klog.Fatalf("could not initialize Instances: %v", err)
+	}
+	lb, err := newLoadBalancers(c.client, devices, clientset, recorder, bgp.localASN, bgp.bgpPass, c.config)
 	if err != nil {
 		klog.Fatalf("could not initialize LoadBalancers: %v", err)
 	}
 
+	// only the EIPs of BGP load balancers are reserved by the CCM
+	if lb != nil && lb.usesBGP {
+		gc, err := newEIPGarbageCollector(c.client, clientset, lb.clusterID, lb.ipam, lb.implementor, c.config)
+		if err != nil {
+			klog.Fatalf("could not initialize EIP garbage collector: %v", err)
+		}
+		go gc.run(stop)
+	}
+
 	c.loadBalancer = lb
 	c.bgp = bgp
-	c.instances = newInstances(c.client.DevicesApi, c.config.ProjectID)
+	c.instances = instances
 	c.controlPlaneEndpointManager = epm
 	c.controlPlaneLoadBalancerManager = lbm
+	c.spotTerminationManager = stm
+	c.deviceStateManager = dsm
+	if c.config.VRFID != "" {
+		klog.Infof("routes enabled in VRF %s", c.config.VRFID)
+		c.routes = newRoutes(c.client, c.config.VRFID)
+	}
 
 	klog.Info("Initialize of cloud provider complete")
 }
@@ -140,7 +211,10 @@ func (c *cloud) Clusters() (cloudprovider.Clusters, bool) {
 // Routes returns a routes interface along with whether the interface is supported.
 func (c *cloud) Routes() (cloudprovider.Routes, bool) {
 	klog.V(5).Info("called Routes")
-	return nil, false
+	if c.routes == nil {
+		return nil, false
+	}
+	return c.routes, true
 }
 
 // ProviderName returns the cloud provider ID.
@@ -155,6 +229,44 @@ func (c *cloud) HasClusterID() bool {
 	return true
 }
 
+// apiTransportConfig returns the rate limit and retries of the requests to the Equinix Metal APIs
+func apiTransportConfig(metalConfig Config) (transport.Config, error) {
+	backoff, err := parseDuration(metalConfig.APIRetryBackoff, DefaultAPIRetryBackoff)
+	if err != nil {
+		return transport.Config{}, err
+	}
+	return transport.Config{
+		RateLimit:  float64(metalConfig.APIRateLimit),
+		RateBurst:  metalConfig.APIRateBurst,
+		MaxRetries: metalConfig.APIMaxRetries,
+		MinBackoff: backoff,
+		MaxBackoff: max(backoff, maxAPIRetryBackoff),
+	}, nil
+}
+
+// apiHTTPTransport returns the transport of the requests to the Equinix Metal APIs, which trusts the
+// certificate authorities of the PEM file caBundle as well as those of the system, if it is set
+func apiHTTPTransport(caBundle string) (http.RoundTripper, error) {
+	if caBundle == "" {
+		return http.DefaultTransport, nil
+	}
+	pem, err := os.ReadFile(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		klog.Warningf("unable to load the system certificate authorities, trusting only CA bundle %s: %v", caBundle, err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in CA bundle %s", caBundle)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return t, nil
+}
+
 func checkDebugEnabled() bool {
 	_, legacyVarIsSet := os.LookupEnv("PACKNGO_DEBUG")
 	return legacyVarIsSet
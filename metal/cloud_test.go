@@ -1,9 +1,13 @@
 package metal
 
 import (
+	"encoding/pem"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 
 	metaltest "sigs.k8s.io/cloud-provider-equinix-metal/metal/testing"
@@ -209,3 +213,37 @@ func constructClient(authToken string, baseUrl *string) *metal.APIClient {
 
 	return metal.NewAPIClient(configuration)
 }
+
+func TestAPIHTTPTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// the certificate of the server is trusted only with the CA bundle
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("unable to write CA bundle: %v", err)
+	}
+	for _, tt := range []struct {
+		caBundle string
+		trusted  bool
+	}{
+		{"", false},
+		{caBundle, true},
+	} {
+		tr, err := apiHTTPTransport(tt.caBundle)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp, err := (&http.Client{Transport: tr}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tt.trusted {
+			t.Errorf("mismatched trust with CA bundle %q, error %v", tt.caBundle, err)
+		}
+	}
+
+	if _, err := apiHTTPTransport(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("expected error for a missing CA bundle")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"strconv"
+	"time"
 
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/klog/v2"
@@ -27,11 +29,39 @@ const (
 	envVarAnnotationNetworkIPv4Private = "METAL_ANNOTATION_NETWORK_IPV4_PRIVATE"
 	envVarAnnotationEIPMetro           = "METAL_ANNOTATION_EIP_METRO"
 	envVarAnnotationEIPFacility        = "METAL_ANNOTATION_EIP_FACILITY"
+	envVarAnnotationEIPGlobal          = "METAL_ANNOTATION_EIP_GLOBAL"
+	envVarAnnotationEIPReservationID   = "METAL_ANNOTATION_EIP_RESERVATION_ID"
+	envVarAnnotationEIPReservationTag  = "METAL_ANNOTATION_EIP_RESERVATION_TAG"
+	envVarAnnotationEIPSharingKey      = "METAL_ANNOTATION_EIP_SHARING_KEY"
+	envVarAnnotationEIPAssigned        = "METAL_ANNOTATION_EIP_ASSIGNED"
 	envVarEIPTag                       = "METAL_EIP_TAG"
 	envVarAPIServerPort                = "METAL_API_SERVER_PORT"
 	envVarBGPNodeSelector              = "METAL_BGP_NODE_SELECTOR"
 	envVarEIPHealthCheckUseHostIP      = "METAL_EIP_HEALTH_CHECK_USE_HOST_IP"
 	envVarLoadBalancerID               = "METAL_LOAD_BALANCER_ID"
+	envVarZoneSource                   = "METAL_ZONE_SOURCE"
+	envVarPrimaryIPFamily              = "METAL_PRIMARY_IP_FAMILY"
+	envVarAllowPrivateOnlyNodes        = "METAL_ALLOW_PRIVATE_ONLY_NODES"
+	envVarDeviceCacheRefreshInterval   = "METAL_DEVICE_CACHE_REFRESH_INTERVAL"
+	envVarDeviceCacheMaxStaleness      = "METAL_DEVICE_CACHE_MAX_STALENESS"
+	envVarSpotTerminationLeadTime      = "METAL_SPOT_TERMINATION_LEAD_TIME"
+	envVarNodeMatching                 = "METAL_NODE_MATCHING"
+	envVarVRFID                        = "METAL_VRF_ID"
+	envVarBGPDeploymentType            = "METAL_BGP_DEPLOYMENT_TYPE"
+	envVarEIPBlockSize                 = "METAL_EIP_BLOCK_SIZE"
+	envVarEIPBlockID                   = "METAL_EIP_BLOCK_ID"
+	envVarEIPAssignment                = "METAL_EIP_ASSIGNMENT"
+	envVarEIPGCInterval                = "METAL_EIP_GC_INTERVAL"
+	envVarEIPGCGracePeriod             = "METAL_EIP_GC_GRACE_PERIOD"
+	envVarEIPGCDryRun                  = "METAL_EIP_GC_DRY_RUN"
+	envVarAPIRateLimit                 = "METAL_API_RATE_LIMIT"
+	envVarAPIRateBurst                 = "METAL_API_RATE_BURST"
+	envVarAPIMaxRetries                = "METAL_API_MAX_RETRIES"
+	envVarAPIRetryBackoff              = "METAL_API_RETRY_BACKOFF"
+	envVarBaseURL                      = "METAL_BASE_URL"
+	envVarLBaaSBaseURL                 = "METAL_LBAAS_BASE_URL"
+	envVarTokenExchangeURL             = "METAL_TOKEN_EXCHANGE_URL"
+	envVarCABundle                     = "METAL_CA_BUNDLE"
 )
 
 // Config configuration for a provider, includes authentication token, project ID ID, and optional override URL to talk to a different Equinix Metal API endpoint
@@ -52,11 +82,38 @@ type Config struct {
 	AnnotationNetworkIPv4Private string  `json:"annotationNetworkIPv4Private,omitempty"`
 	AnnotationEIPMetro           string  `json:"annotationEIPMetro,omitempty"`
 	AnnotationEIPFacility        string  `json:"annotationEIPFacility,omitempty"`
+	AnnotationEIPGlobal          string  `json:"annotationEIPGlobal,omitempty"`
+	AnnotationEIPReservationID   string  `json:"annotationEIPReservationID,omitempty"`
+	AnnotationEIPReservationTag  string  `json:"annotationEIPReservationTag,omitempty"`
+	AnnotationEIPSharingKey      string  `json:"annotationEIPSharingKey,omitempty"`
+	AnnotationEIPAssigned        string  `json:"annotationEIPAssigned,omitempty"`
 	EIPTag                       string  `json:"eipTag,omitempty"`
 	APIServerPort                int32   `json:"apiServerPort,omitempty"`
 	BGPNodeSelector              string  `json:"bgpNodeSelector,omitempty"`
 	EIPHealthCheckUseHostIP      bool    `json:"eipHealthCheckUseHostIP,omitempty"`
 	LoadBalancerID               string  `json:"loadBalancerID,omitempty"`
+	ZoneSource                   string  `json:"zoneSource,omitempty"`
+	PrimaryIPFamily              string  `json:"primaryIPFamily,omitempty"`
+	AllowPrivateOnlyNodes        bool    `json:"allowPrivateOnlyNodes,omitempty"`
+	DeviceCacheRefreshInterval   string  `json:"deviceCacheRefreshInterval,omitempty"`
+	DeviceCacheMaxStaleness      string  `json:"deviceCacheMaxStaleness,omitempty"`
+	SpotTerminationLeadTime      string  `json:"spotTerminationLeadTime,omitempty"`
+	NodeMatching                 string  `json:"nodeMatching,omitempty"`
+	VRFID                        string  `json:"vrfID,omitempty"`
+	BGPDeploymentType            string  `json:"bgpDeploymentType,omitempty"`
+	EIPBlockSize                 int     `json:"eipBlockSize,omitempty"`
+	EIPBlockID                   string  `json:"eipBlockID,omitempty"`
+	EIPAssignment                string  `json:"eipAssignment,omitempty"`
+	EIPGCInterval                string  `json:"eipGCInterval,omitempty"`
+	EIPGCGracePeriod             string  `json:"eipGCGracePeriod,omitempty"`
+	EIPGCDryRun                  bool    `json:"eipGCDryRun,omitempty"`
+	APIRateLimit                 int     `json:"apiRateLimit,omitempty"`
+	APIRateBurst                 int     `json:"apiRateBurst,omitempty"`
+	APIMaxRetries                int     `json:"apiMaxRetries,omitempty"`
+	APIRetryBackoff              string  `json:"apiRetryBackoff,omitempty"`
+	LBaaSBaseURL                 string  `json:"lbaasBaseURL,omitempty"`
+	TokenExchangeURL             string  `json:"tokenExchangeURL,omitempty"`
+	CABundle                     string  `json:"caBundle,omitempty"`
 }
 
 // String converts the Config structure to a string, while masking hidden fields.
@@ -82,6 +139,33 @@ func (c Config) Strings() []string {
 	ret = append(ret, fmt.Sprintf("API Server Port: '%d'", c.APIServerPort))
 	ret = append(ret, fmt.Sprintf("BGP Node Selector: '%s'", c.BGPNodeSelector))
 	ret = append(ret, fmt.Sprintf("Load Balancer ID: '%s'", c.LoadBalancerID))
+	ret = append(ret, fmt.Sprintf("Zone Source: '%s'", c.ZoneSource))
+	ret = append(ret, fmt.Sprintf("Primary IP Family: '%s'", c.PrimaryIPFamily))
+	ret = append(ret, fmt.Sprintf("Allow Private Only Nodes: '%t'", c.AllowPrivateOnlyNodes))
+	ret = append(ret, fmt.Sprintf("Device Cache Refresh Interval: '%s'", c.DeviceCacheRefreshInterval))
+	ret = append(ret, fmt.Sprintf("Device Cache Max Staleness: '%s'", c.DeviceCacheMaxStaleness))
+	ret = append(ret, fmt.Sprintf("Spot Termination Lead Time: '%s'", c.SpotTerminationLeadTime))
+	ret = append(ret, fmt.Sprintf("Node Matching: '%s'", c.NodeMatching))
+	ret = append(ret, fmt.Sprintf("VRF ID: '%s'", c.VRFID))
+	ret = append(ret, fmt.Sprintf("BGP Deployment Type: '%s'", c.BGPDeploymentType))
+	ret = append(ret, fmt.Sprintf("EIP Block Size: '%d'", c.EIPBlockSize))
+	ret = append(ret, fmt.Sprintf("EIP Block ID: '%s'", c.EIPBlockID))
+	ret = append(ret, fmt.Sprintf("EIP Assignment: '%s'", c.EIPAssignment))
+	ret = append(ret, fmt.Sprintf("EIP GC Interval: '%s'", c.EIPGCInterval))
+	ret = append(ret, fmt.Sprintf("EIP GC Grace Period: '%s'", c.EIPGCGracePeriod))
+	ret = append(ret, fmt.Sprintf("EIP GC Dry Run: '%t'", c.EIPGCDryRun))
+	ret = append(ret, fmt.Sprintf("API Rate Limit: '%d'", c.APIRateLimit))
+	ret = append(ret, fmt.Sprintf("API Rate Burst: '%d'", c.APIRateBurst))
+	ret = append(ret, fmt.Sprintf("API Max Retries: '%d'", c.APIMaxRetries))
+	ret = append(ret, fmt.Sprintf("API Retry Backoff: '%s'", c.APIRetryBackoff))
+	if c.BaseURL != nil {
+		ret = append(ret, fmt.Sprintf("Base URL: '%s'", *c.BaseURL))
+	} else {
+		ret = append(ret, "Base URL: default")
+	}
+	ret = append(ret, fmt.Sprintf("LBaaS Base URL: '%s'", c.LBaaSBaseURL))
+	ret = append(ret, fmt.Sprintf("Token Exchange URL: '%s'", c.TokenExchangeURL))
+	ret = append(ret, fmt.Sprintf("CA Bundle: '%s'", c.CABundle))
 
 	return ret
 }
@@ -166,6 +250,16 @@ func getMetalConfig(providerConfig io.Reader) (Config, error) {
 
 	config.AnnotationEIPFacility = override(os.Getenv(envVarAnnotationEIPFacility), rawConfig.AnnotationEIPFacility, DefaultAnnotationEIPFacility)
 
+	config.AnnotationEIPGlobal = override(os.Getenv(envVarAnnotationEIPGlobal), rawConfig.AnnotationEIPGlobal, DefaultAnnotationEIPGlobal)
+
+	config.AnnotationEIPReservationID = override(os.Getenv(envVarAnnotationEIPReservationID), rawConfig.AnnotationEIPReservationID, DefaultAnnotationEIPReservationID)
+
+	config.AnnotationEIPReservationTag = override(os.Getenv(envVarAnnotationEIPReservationTag), rawConfig.AnnotationEIPReservationTag, DefaultAnnotationEIPReservationTag)
+
+	config.AnnotationEIPSharingKey = override(os.Getenv(envVarAnnotationEIPSharingKey), rawConfig.AnnotationEIPSharingKey, DefaultAnnotationEIPSharingKey)
+
+	config.AnnotationEIPAssigned = override(os.Getenv(envVarAnnotationEIPAssigned), rawConfig.AnnotationEIPAssigned, DefaultAnnotationEIPAssigned)
+
 	config.EIPTag = override(os.Getenv(envVarEIPTag), rawConfig.EIPTag)
 
 	config.LoadBalancerID = override(os.Getenv(envVarLoadBalancerID), rawConfig.LoadBalancerID)
@@ -191,6 +285,47 @@ func getMetalConfig(providerConfig io.Reader) (Config, error) {
 		return config, fmt.Errorf("BGP Node Selector must be valid Kubernetes selector: %w", err)
 	}
 
+	config.BGPDeploymentType = override(os.Getenv(envVarBGPDeploymentType), rawConfig.BGPDeploymentType, DefaultBGPDeploymentType)
+
+	if config.BGPDeploymentType != bgpDeploymentTypeLocal && config.BGPDeploymentType != bgpDeploymentTypeGlobal {
+		return config, fmt.Errorf("BGP deployment type must be %q or %q, was %q", bgpDeploymentTypeLocal, bgpDeploymentTypeGlobal, config.BGPDeploymentType)
+	}
+
+	eipBlockSize := os.Getenv(envVarEIPBlockSize)
+	switch {
+	case eipBlockSize != "":
+		eipBlockSizeNo, err := strconv.Atoi(eipBlockSize)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %w", envVarEIPBlockSize, eipBlockSize, err)
+		}
+		config.EIPBlockSize = eipBlockSizeNo
+	default:
+		config.EIPBlockSize = rawConfig.EIPBlockSize
+	}
+	if config.EIPBlockSize != 0 && (config.EIPBlockSize < minEIPBlockSize || config.EIPBlockSize > maxEIPBlockSize) {
+		return config, fmt.Errorf("EIP block size must be a prefix length from %d to %d, was %d", minEIPBlockSize, maxEIPBlockSize, config.EIPBlockSize)
+	}
+
+	config.EIPBlockID = override(os.Getenv(envVarEIPBlockID), rawConfig.EIPBlockID)
+
+	config.EIPAssignment = override(os.Getenv(envVarEIPAssignment), rawConfig.EIPAssignment, DefaultEIPAssignment)
+
+	if config.EIPAssignment != eipAssignmentSpec && config.EIPAssignment != eipAssignmentAnnotation {
+		return config, fmt.Errorf("EIP assignment must be %q or %q, was %q", eipAssignmentSpec, eipAssignmentAnnotation, config.EIPAssignment)
+	}
+
+	config.ZoneSource = override(os.Getenv(envVarZoneSource), rawConfig.ZoneSource, DefaultZoneSource)
+
+	if _, err := parseZoneSources(config.ZoneSource); err != nil {
+		return config, fmt.Errorf("zone source must be a comma-separated list of %v or %q: %w", validZoneSources, zoneSourceNone, err)
+	}
+
+	config.PrimaryIPFamily = override(os.Getenv(envVarPrimaryIPFamily), rawConfig.PrimaryIPFamily, DefaultPrimaryIPFamily)
+
+	if _, err := parseIPFamily(config.PrimaryIPFamily); err != nil {
+		return config, fmt.Errorf("primary IP family must be valid: %w", err)
+	}
+
 	config.EIPHealthCheckUseHostIP = rawConfig.EIPHealthCheckUseHostIP
 	if v := os.Getenv(envVarEIPHealthCheckUseHostIP); v != "" {
 		useHostIP, err := strconv.ParseBool(v)
@@ -200,9 +335,169 @@ func getMetalConfig(providerConfig io.Reader) (Config, error) {
 		config.EIPHealthCheckUseHostIP = useHostIP
 	}
 
+	config.AllowPrivateOnlyNodes = rawConfig.AllowPrivateOnlyNodes
+	if v := os.Getenv(envVarAllowPrivateOnlyNodes); v != "" {
+		allowPrivateOnly, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %w", envVarAllowPrivateOnlyNodes, v, err)
+		}
+		config.AllowPrivateOnlyNodes = allowPrivateOnly
+	}
+
+	config.DeviceCacheRefreshInterval = override(os.Getenv(envVarDeviceCacheRefreshInterval), rawConfig.DeviceCacheRefreshInterval, DefaultDeviceCacheRefreshInterval)
+
+	if _, err := parseDuration(config.DeviceCacheRefreshInterval, DefaultDeviceCacheRefreshInterval); err != nil {
+		return config, fmt.Errorf("device cache refresh interval must be a valid duration: %w", err)
+	}
+
+	config.DeviceCacheMaxStaleness = override(os.Getenv(envVarDeviceCacheMaxStaleness), rawConfig.DeviceCacheMaxStaleness, DefaultDeviceCacheMaxStaleness)
+
+	if _, err := parseDuration(config.DeviceCacheMaxStaleness, DefaultDeviceCacheMaxStaleness); err != nil {
+		return config, fmt.Errorf("device cache max staleness must be a valid duration: %w", err)
+	}
+
+	config.SpotTerminationLeadTime = override(os.Getenv(envVarSpotTerminationLeadTime), rawConfig.SpotTerminationLeadTime, DefaultSpotTerminationLeadTime)
+
+	if _, err := parseDuration(config.SpotTerminationLeadTime, DefaultSpotTerminationLeadTime); err != nil {
+		return config, fmt.Errorf("spot termination lead time must be a valid duration: %w", err)
+	}
+
+	config.EIPGCInterval = override(os.Getenv(envVarEIPGCInterval), rawConfig.EIPGCInterval, DefaultEIPGCInterval)
+
+	if _, err := parseDuration(config.EIPGCInterval, DefaultEIPGCInterval); err != nil {
+		return config, fmt.Errorf("EIP GC interval must be a valid duration: %w", err)
+	}
+
+	config.EIPGCGracePeriod = override(os.Getenv(envVarEIPGCGracePeriod), rawConfig.EIPGCGracePeriod, DefaultEIPGCGracePeriod)
+
+	if _, err := parseDuration(config.EIPGCGracePeriod, DefaultEIPGCGracePeriod); err != nil {
+		return config, fmt.Errorf("EIP GC grace period must be a valid duration: %w", err)
+	}
+
+	config.EIPGCDryRun = rawConfig.EIPGCDryRun
+	if v := os.Getenv(envVarEIPGCDryRun); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %w", envVarEIPGCDryRun, v, err)
+		}
+		config.EIPGCDryRun = dryRun
+	}
+
+	apiRateLimit := os.Getenv(envVarAPIRateLimit)
+	switch {
+	case apiRateLimit != "":
+		apiRateLimitNo, err := strconv.Atoi(apiRateLimit)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %w", envVarAPIRateLimit, apiRateLimit, err)
+		}
+		config.APIRateLimit = apiRateLimitNo
+	case rawConfig.APIRateLimit != 0:
+		config.APIRateLimit = rawConfig.APIRateLimit
+	default:
+		config.APIRateLimit = DefaultAPIRateLimit
+	}
+
+	apiRateBurst := os.Getenv(envVarAPIRateBurst)
+	switch {
+	case apiRateBurst != "":
+		apiRateBurstNo, err := strconv.Atoi(apiRateBurst)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %w", envVarAPIRateBurst, apiRateBurst, err)
+		}
+		config.APIRateBurst = apiRateBurstNo
+	case rawConfig.APIRateBurst != 0:
+		config.APIRateBurst = rawConfig.APIRateBurst
+	default:
+		config.APIRateBurst = DefaultAPIRateBurst
+	}
+
+	apiMaxRetries := os.Getenv(envVarAPIMaxRetries)
+	switch {
+	case apiMaxRetries != "":
+		apiMaxRetriesNo, err := strconv.Atoi(apiMaxRetries)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %w", envVarAPIMaxRetries, apiMaxRetries, err)
+		}
+		config.APIMaxRetries = apiMaxRetriesNo
+	case rawConfig.APIMaxRetries != 0:
+		config.APIMaxRetries = rawConfig.APIMaxRetries
+	default:
+		config.APIMaxRetries = DefaultAPIMaxRetries
+	}
+	if config.APIRateLimit < 0 || config.APIRateBurst < 0 || config.APIMaxRetries < 0 {
+		return config, fmt.Errorf("API rate limit, burst and max retries may not be negative, were %d, %d and %d", config.APIRateLimit, config.APIRateBurst, config.APIMaxRetries)
+	}
+
+	config.APIRetryBackoff = override(os.Getenv(envVarAPIRetryBackoff), rawConfig.APIRetryBackoff, DefaultAPIRetryBackoff)
+
+	if _, err := parseDuration(config.APIRetryBackoff, DefaultAPIRetryBackoff); err != nil {
+		return config, fmt.Errorf("API retry backoff must be a valid duration: %w", err)
+	}
+
+	config.BaseURL = rawConfig.BaseURL
+	if v := os.Getenv(envVarBaseURL); v != "" {
+		config.BaseURL = &v
+	}
+	if config.BaseURL != nil {
+		if err := validateURL(*config.BaseURL); err != nil {
+			return config, fmt.Errorf("base URL must be valid: %w", err)
+		}
+	}
+
+	config.LBaaSBaseURL = override(os.Getenv(envVarLBaaSBaseURL), rawConfig.LBaaSBaseURL)
+
+	if config.LBaaSBaseURL != "" {
+		if err := validateURL(config.LBaaSBaseURL); err != nil {
+			return config, fmt.Errorf("LBaaS base URL must be valid: %w", err)
+		}
+	}
+
+	config.TokenExchangeURL = override(os.Getenv(envVarTokenExchangeURL), rawConfig.TokenExchangeURL)
+
+	if config.TokenExchangeURL != "" {
+		if err := validateURL(config.TokenExchangeURL); err != nil {
+			return config, fmt.Errorf("token exchange URL must be valid: %w", err)
+		}
+	}
+
+	config.CABundle = override(os.Getenv(envVarCABundle), rawConfig.CABundle)
+
+	config.NodeMatching = override(os.Getenv(envVarNodeMatching), rawConfig.NodeMatching, DefaultNodeMatching)
+
+	if _, err := parseNodeMatches(config.NodeMatching); err != nil {
+		return config, fmt.Errorf("node matching must be a comma-separated list of %v, where tag matches devices tagged %s: %w", validNodeMatches, nodeTag("<node name>"), err)
+	}
+
+	config.VRFID = override(os.Getenv(envVarVRFID), rawConfig.VRFID)
+
 	return config, nil
 }
 
+// parseDuration parses a duration such as "90s" or "5m", which may not be negative.
+// An empty value returns the default.
+func parseDuration(setting, defaultSetting string) (time.Duration, error) {
+	d, err := time.ParseDuration(override(setting, defaultSetting))
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %s may not be negative", setting)
+	}
+	return d, nil
+}
+
+// validateURL checks that a URL to an API is absolute, with an http or https scheme
+func validateURL(setting string) error {
+	u, err := url.Parse(setting)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("URL %s must be absolute, with an http or https scheme", setting)
+	}
+	return nil
+}
+
 // printMetalConfig report the config to startup logs
 func printMetalConfig(config Config) {
 	lines := config.Strings()
@@ -6,6 +6,8 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+
+	"k8s.io/utils/ptr"
 )
 
 func Test_getMetalConfig(t *testing.T) {
@@ -28,7 +30,29 @@ func Test_getMetalConfig(t *testing.T) {
 		AnnotationNetworkIPv4Private: DefaultAnnotationNetworkIPv4Private,
 		AnnotationEIPMetro:           DefaultAnnotationEIPMetro,
 		AnnotationEIPFacility:        DefaultAnnotationEIPFacility,
+		AnnotationEIPGlobal:          DefaultAnnotationEIPGlobal,
+		AnnotationEIPReservationID:   DefaultAnnotationEIPReservationID,
+		AnnotationEIPReservationTag:  DefaultAnnotationEIPReservationTag,
+		AnnotationEIPSharingKey:      DefaultAnnotationEIPSharingKey,
+		AnnotationEIPAssigned:        DefaultAnnotationEIPAssigned,
+		ZoneSource:                   DefaultZoneSource,
+		PrimaryIPFamily:              DefaultPrimaryIPFamily,
+		DeviceCacheRefreshInterval:   DefaultDeviceCacheRefreshInterval,
+		DeviceCacheMaxStaleness:      DefaultDeviceCacheMaxStaleness,
+		SpotTerminationLeadTime:      DefaultSpotTerminationLeadTime,
+		NodeMatching:                 DefaultNodeMatching,
+		BGPDeploymentType:            DefaultBGPDeploymentType,
+		EIPAssignment:                DefaultEIPAssignment,
+		EIPGCInterval:                DefaultEIPGCInterval,
+		EIPGCGracePeriod:             DefaultEIPGCGracePeriod,
+		APIRateLimit:                 DefaultAPIRateLimit,
+		APIRateBurst:                 DefaultAPIRateBurst,
+		APIMaxRetries:                DefaultAPIMaxRetries,
+		APIRetryBackoff:              DefaultAPIRetryBackoff,
 	}
+	baseURLConfig := defaultConfig
+	baseURLConfig.BaseURL = ptr.To("http://localhost:8080/metal/v1")
+	baseURLConfig.LBaaSBaseURL = "http://localhost:8080"
 	tests := []struct {
 		name    string
 		args    args
@@ -97,6 +121,22 @@ func Test_getMetalConfig(t *testing.T) {
 			want:    Config{},
 			wantErr: true,
 		},
+		{
+			name: "base url env overrides json config",
+			args: args{
+				providerConfig: strings.NewReader(`{
+					"apiKey": "test",
+					"projectId": "test",
+					"base-url": "https://metal.example.com/metal/v1",
+					"lbaasBaseURL": "http://localhost:8080"
+				}`),
+			},
+			want:    baseURLConfig,
+			wantErr: false,
+			env: map[string]string{
+				"METAL_BASE_URL": "http://localhost:8080/metal/v1",
+			},
+		},
 		{
 			name: "invalid json",
 			args: args{
@@ -126,3 +166,22 @@ func Test_getMetalConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://api.equinix.com/metal/v1", true},
+		{"http://localhost:8080", true},
+		{"metal.example.com", false},
+		{"ftp://metal.example.com", false},
+		{"https://", false},
+	}
+
+	for _, tt := range tests {
+		if err := validateURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("mismatched validity of %q, error %v", tt.url, err)
+		}
+	}
+}
@@ -3,6 +3,10 @@ package metal
 const (
 	emIdentifier                        = "cloud-provider-equinix-metal-auto"
 	emTag                               = "usage=" + emIdentifier
+	adoptedTag                          = "adopted-by=" + emIdentifier
+	serviceTagPrefix                    = "service="
+	clusterTagPrefix                    = "cluster="
+	sharingKeyTagPrefix                 = "sharing-key="
 	ccmIPDescription                    = "Equinix Metal Kubernetes CCM auto-generated for Load Balancer"
 	DefaultAnnotationNodeASN            = "metal.equinix.com/bgp-peers-{{n}}-node-asn"
 	DefaultAnnotationPeerASN            = "metal.equinix.com/bgp-peers-{{n}}-peer-asn"
@@ -12,6 +16,33 @@ const (
 	DefaultAnnotationNetworkIPv4Private = "metal.equinix.com/network-4-private"
 	DefaultAnnotationEIPMetro           = "metal.equinix.com/eip-metro"
 	DefaultAnnotationEIPFacility        = "metal.equinix.com/eip-facility"
+	DefaultAnnotationEIPGlobal          = "metal.equinix.com/eip-global"
+	DefaultAnnotationEIPReservationID   = "metal.equinix.com/eip-reservation-id"
+	DefaultAnnotationEIPReservationTag  = "metal.equinix.com/eip-reservation-tag"
+	DefaultAnnotationEIPSharingKey      = "metal.equinix.com/eip-sharing-key"
+	DefaultAnnotationEIPAssigned        = "metal.equinix.com/eip-assigned"
 	DefaultLocalASN                     = 65000
 	DefaultPeerASN                      = 65530
+	DefaultZoneSource                   = "facility,hardware-reservation"
+	DefaultPrimaryIPFamily              = "IPv4"
+	DefaultDeviceCacheRefreshInterval   = "1m"
+	DefaultDeviceCacheMaxStaleness      = "5m"
+	DefaultSpotTerminationLeadTime      = "10m"
+	DefaultNodeMatching                 = "hostname"
+	DefaultBGPDeploymentType            = bgpDeploymentTypeLocal
+	DefaultEIPAssignment                = eipAssignmentSpec
+	DefaultEIPGCInterval                = "0s"
+	DefaultEIPGCGracePeriod             = "1h"
+	DefaultAPIRateLimit                 = 10
+	DefaultAPIRateBurst                 = 20
+	DefaultAPIMaxRetries                = 3
+	DefaultAPIRetryBackoff              = "1s"
+
+	// node labels describing the device, set via InstanceMetadata
+	LabelPlanClass             = "metal.equinix.com/plan-class"
+	LabelHardwareReservationID = "metal.equinix.com/hardware-reservation-id"
+	LabelSpotInstance          = "metal.equinix.com/spot-instance"
+	LabelOperatingSystem       = "metal.equinix.com/operating-system"
+	LabelNetworkMode           = "metal.equinix.com/network-mode"
+	LabelBillingCycle          = "metal.equinix.com/billing-cycle"
 )
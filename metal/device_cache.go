@@ -0,0 +1,228 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// deviceIncludes are the related resources included with every device retrieved,
+// so that cached devices can be used for any lookup, including the private network
+var deviceIncludes = []string{"ip_addresses.parent_block,parent_block"}
+
+// minDeviceCacheRefreshInterval is the minimum time between two refreshes of the
+// device cache caused by lookups of devices not in the cache, so that
+// repeated lookups for a node that has no device do not each list the project
+const minDeviceCacheRefreshInterval = 10 * time.Second
+
+type cachedDevice struct {
+	device  *metal.Device
+	fetched time.Time
+}
+
+// deviceCache is an inventory of the devices in a project, shared by the services
+// that need to look up devices, so that each lookup does not call the Equinix Metal API.
+//
+// The inventory is refreshed by listing all of the devices in the project, both in the
+// background every refreshInterval, and when a device is looked up other than by ID and
+// is not found. Cached devices are returned only if they were retrieved no more than
+// maxStaleness ago; older devices are retrieved again. A maxStaleness of 0 disables
+// the cache, and every lookup calls the API. Devices returned share their nested values
+// with the cache, and must not be changed.
+type deviceCache struct {
+	client          *metal.DevicesApiService
+	project         string
+	refreshInterval time.Duration
+	maxStaleness    time.Duration
+
+	lock sync.RWMutex
+	byID map[string]cachedDevice
+	// all is every device in the project, in the order listed at lastRefresh
+	all         []*metal.Device
+	lastRefresh time.Time
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func newDeviceCache(client *metal.DevicesApiService, metalConfig Config) (*deviceCache, error) {
+	refreshInterval, err := parseDuration(metalConfig.DeviceCacheRefreshInterval, DefaultDeviceCacheRefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+	maxStaleness, err := parseDuration(metalConfig.DeviceCacheMaxStaleness, DefaultDeviceCacheMaxStaleness)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceCache{
+		client:          client,
+		project:         metalConfig.ProjectID,
+		refreshInterval: refreshInterval,
+		maxStaleness:    maxStaleness,
+		byID:            map[string]cachedDevice{},
+		now:             time.Now,
+	}, nil
+}
+
+// run refreshes the cache every refreshInterval until stop is closed. The first refresh
+// happens after one interval, as the cache is filled on demand by lookups until then.
+func (d *deviceCache) run(stop <-chan struct{}) {
+	if d.refreshInterval <= 0 || d.maxStaleness <= 0 {
+		klog.V(2).Info("deviceCache.run(): background refresh disabled")
+		return
+	}
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := d.refresh(context.Background()); err != nil {
+				klog.Errorf("failed to refresh device cache for project %s: %v", d.project, err)
+			}
+		}
+	}
+}
+
+// refresh replaces the contents of the cache with all of the devices in the project, from all pages
+func (d *deviceCache) refresh(ctx context.Context) error {
+	klog.V(5).Infof("deviceCache.refresh(): listing devices for project %s", d.project)
+	devices, err := d.client.FindProjectDevices(ctx, d.project).
+		Include(deviceIncludes).
+		ExecuteWithPagination()
+	if err != nil {
+		return fmt.Errorf("error listing devices for project %s: %w", d.project, err)
+	}
+
+	now := d.now()
+	byID := make(map[string]cachedDevice, len(devices.GetDevices()))
+	all := make([]*metal.Device, 0, len(devices.GetDevices()))
+	for i := range devices.Devices {
+		device := &devices.Devices[i]
+		byID[device.GetId()] = cachedDevice{device: device, fetched: now}
+		all = append(all, device)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.byID = byID
+	d.all = all
+	d.lastRefresh = now
+	klog.V(5).Infof("deviceCache.refresh(): cached %d devices for project %s", len(byID), d.project)
+	return nil
+}
+
+// fresh returns true if something fetched at the given time may still be used
+func (d *deviceCache) fresh(fetched time.Time) bool {
+	return d.freshWithin(fetched, d.maxStaleness)
+}
+
+// freshWithin returns true if something fetched at the given time is no older than maxStaleness,
+// nor than the maxStaleness of the cache
+func (d *deviceCache) freshWithin(fetched time.Time, maxStaleness time.Duration) bool {
+	return d.maxStaleness > 0 && !fetched.IsZero() && d.now().Sub(fetched) <= min(maxStaleness, d.maxStaleness)
+}
+
+// deviceByID returns the device with the given ID, from the cache if it is fresh enough,
+// else from the API. It returns cloudprovider.InstanceNotFound if there is no such device.
+func (d *deviceCache) deviceByID(ctx context.Context, id string) (*metal.Device, error) {
+	return d.deviceByIDWithin(ctx, id, d.maxStaleness)
+}
+
+// deviceByIDWithin returns the device with the given ID, like deviceByID, but from the cache only
+// if it was retrieved no more than maxStaleness ago, for lookups that need a fresher device
+func (d *deviceCache) deviceByIDWithin(ctx context.Context, id string, maxStaleness time.Duration) (*metal.Device, error) {
+	d.lock.RLock()
+	entry, ok := d.byID[id]
+	d.lock.RUnlock()
+	if ok && d.freshWithin(entry.fetched, maxStaleness) {
+		klog.V(5).Infof("deviceCache.deviceByID(): cache hit for %s", id)
+		return copyDevice(entry.device), nil
+	}
+
+	klog.V(2).Infof("called deviceByID with ID %s", id)
+	device, resp, err := d.client.FindDeviceById(ctx, id).Include(deviceIncludes).Execute()
+	if isNotFound(resp, err) {
+		d.remove(id)
+		return nil, cloudprovider.InstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.store(device)
+	return copyDevice(device), nil
+}
+
+// deviceByHostname returns the device with the given hostname.
+// It returns cloudprovider.InstanceNotFound if there is no such device.
+func (d *deviceCache) deviceByHostname(ctx context.Context, hostname string) (*metal.Device, error) {
+	return d.deviceMatching(ctx, func(device *metal.Device) bool {
+		return device.GetHostname() == hostname
+	})
+}
+
+// deviceMatching returns the first device in the project for which match returns true. If the
+// cache is not fresh enough, or has no such device, it is refreshed first, unless it was refreshed
+// very recently. It returns cloudprovider.InstanceNotFound if there is no such device.
+func (d *deviceCache) deviceMatching(ctx context.Context, match func(*metal.Device) bool) (*metal.Device, error) {
+	find := func() *metal.Device {
+		d.lock.RLock()
+		defer d.lock.RUnlock()
+		for _, device := range d.all {
+			if match(device) {
+				return copyDevice(device)
+			}
+		}
+		return nil
+	}
+
+	d.lock.RLock()
+	lastRefresh := d.lastRefresh
+	d.lock.RUnlock()
+	if d.fresh(lastRefresh) {
+		if device := find(); device != nil {
+			klog.V(5).Infof("deviceCache.deviceMatching(): cache hit for %s", device.GetId())
+			return device, nil
+		}
+	}
+
+	if !d.fresh(lastRefresh) || d.now().Sub(lastRefresh) >= minDeviceCacheRefreshInterval {
+		if err := d.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if device := find(); device != nil {
+		return device, nil
+	}
+	return nil, cloudprovider.InstanceNotFound
+}
+
+func (d *deviceCache) store(device *metal.Device) {
+	entry := cachedDevice{device: device, fetched: d.now()}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.byID[device.GetId()] = entry
+}
+
+func (d *deviceCache) remove(id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.byID, id)
+}
+
+// copyDevice returns a shallow copy of a device, so that callers setting its fields do not change the cached
+// device. Its pointer, slice and map fields, such as Metro, IpAddresses and Tags, are still shared with the
+// cache, so callers must treat them as read-only.
+func copyDevice(device *metal.Device) *metal.Device {
+	if device == nil {
+		return nil
+	}
+	c := *device
+	return &c
+}
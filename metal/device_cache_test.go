@@ -0,0 +1,135 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	"github.com/google/uuid"
+	cloudprovider "k8s.io/cloud-provider"
+	metaltest "sigs.k8s.io/cloud-provider-equinix-metal/metal/testing"
+)
+
+func testAddDevice(server *metaltest.MockMetalServer, projectID, hostname string) *metal.Device {
+	uid := uuid.New().String()
+	state := metal.DEVICESTATE_ACTIVE
+	dev := &metal.Device{
+		Id:       &uid,
+		Hostname: &hostname,
+		State:    &state,
+	}
+	server.DeviceStore[uid] = dev
+	project := server.ProjectStore[projectID]
+	project.Devices = append(project.Devices, dev)
+	server.ProjectStore[projectID] = project
+	return dev
+}
+
+func testRemoveDevice(server *metaltest.MockMetalServer, projectID string, dev *metal.Device) {
+	delete(server.DeviceStore, dev.GetId())
+	project := server.ProjectStore[projectID]
+	var devices []*metal.Device
+	for _, d := range project.Devices {
+		if d.GetId() != dev.GetId() {
+			devices = append(devices, d)
+		}
+	}
+	project.Devices = devices
+	server.ProjectStore[projectID] = project
+}
+
+func testDeviceCache(t *testing.T, maxStaleness string) (*deviceCache, *metaltest.MockMetalServer, *time.Time) {
+	vc, server := testGetValidCloud(t, "")
+	config := vc.config
+	config.DeviceCacheMaxStaleness = maxStaleness
+	devices, err := newDeviceCache(vc.client.DevicesApi, config)
+	if err != nil {
+		t.Fatalf("unable to create device cache: %v", err)
+	}
+	now := time.Now()
+	devices.now = func() time.Time { return now }
+	return devices, server, &now
+}
+
+func TestDeviceCacheByID(t *testing.T) {
+	devices, server, now := testDeviceCache(t, "5m")
+	ctx := context.Background()
+	dev := testAddDevice(server, devices.project, testGetNewDevName())
+
+	if _, err := devices.deviceByID(ctx, dev.GetId()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the device is still served from the cache after it is gone from the API
+	testRemoveDevice(server, devices.project, dev)
+	*now = now.Add(4 * time.Minute)
+	device, err := devices.deviceByID(ctx, dev.GetId())
+	if err != nil {
+		t.Fatalf("unexpected error for cached device: %v", err)
+	}
+	if device.GetId() != dev.GetId() {
+		t.Errorf("mismatched id, actual %s expected %s", device.GetId(), dev.GetId())
+	}
+
+	// unless the lookup needs a fresher device
+	if _, err := devices.deviceByIDWithin(ctx, dev.GetId(), time.Minute); !errors.Is(err, cloudprovider.InstanceNotFound) {
+		t.Errorf("mismatched error, actual %v expected %v", err, cloudprovider.InstanceNotFound)
+	}
+	*now = now.Add(2 * time.Minute)
+	if _, err := devices.deviceByID(ctx, dev.GetId()); !errors.Is(err, cloudprovider.InstanceNotFound) {
+		t.Errorf("mismatched error, actual %v expected %v", err, cloudprovider.InstanceNotFound)
+	}
+}
+
+func TestDeviceCacheByHostname(t *testing.T) {
+	devices, server, now := testDeviceCache(t, "5m")
+	ctx := context.Background()
+	existing := testAddDevice(server, devices.project, "existing")
+
+	device, err := devices.deviceByHostname(ctx, "existing")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device.GetId() != existing.GetId() {
+		t.Errorf("mismatched id, actual %s expected %s", device.GetId(), existing.GetId())
+	}
+
+	// a new device is not seen until the cache may be refreshed again
+	created := testAddDevice(server, devices.project, "created")
+	if _, err := devices.deviceByHostname(ctx, "created"); !errors.Is(err, cloudprovider.InstanceNotFound) {
+		t.Errorf("mismatched error, actual %v expected %v", err, cloudprovider.InstanceNotFound)
+	}
+	*now = now.Add(minDeviceCacheRefreshInterval)
+	device, err = devices.deviceByHostname(ctx, "created")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device.GetId() != created.GetId() {
+		t.Errorf("mismatched id, actual %s expected %s", device.GetId(), created.GetId())
+	}
+
+	// the refresh also filled the cache for lookups by ID
+	testRemoveDevice(server, devices.project, created)
+	if _, err := devices.deviceByID(ctx, created.GetId()); err != nil {
+		t.Errorf("unexpected error for cached device: %v", err)
+	}
+}
+
+func TestDeviceCacheDisabled(t *testing.T) {
+	devices, server, _ := testDeviceCache(t, "0s")
+	ctx := context.Background()
+	dev := testAddDevice(server, devices.project, testGetNewDevName())
+
+	if _, err := devices.deviceByID(ctx, dev.GetId()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testRemoveDevice(server, devices.project, dev)
+	if _, err := devices.deviceByID(ctx, dev.GetId()); !errors.Is(err, cloudprovider.InstanceNotFound) {
+		t.Errorf("mismatched error, actual %v expected %v", err, cloudprovider.InstanceNotFound)
+	}
+	if _, err := devices.deviceByHostname(ctx, dev.GetHostname()); !errors.Is(err, cloudprovider.InstanceNotFound) {
+		t.Errorf("mismatched error, actual %v expected %v", err, cloudprovider.InstanceNotFound)
+	}
+}
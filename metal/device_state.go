@@ -0,0 +1,151 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// NodeConditionDeviceActive is the node condition reporting whether the node's device is active;
+// its reason and message give the device state.
+const NodeConditionDeviceActive v1.NodeConditionType = "EquinixMetalDeviceActive"
+
+/*
+deviceStateManager reports the state of the device of every node in the NodeConditionDeviceActive
+condition. The node lifecycle controller only checks whether the nodes that are not ready are shut
+down, so instead all nodes are watched, and resynced every checkLoopTimerSeconds, so that the
+condition follows the device as it changes state, e.g. when it is powered on again.
+*/
+type deviceStateManager struct {
+	k8sclient kubernetes.Interface
+	devices   *deviceCache
+}
+
+func newDeviceStateManager(k8sclient kubernetes.Interface, stop <-chan struct{}, devices *deviceCache) (*deviceStateManager, error) {
+	klog.V(2).Info("newDeviceStateManager()")
+
+	m := &deviceStateManager{
+		k8sclient: k8sclient,
+		devices:   devices,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	sharedInformer := informers.NewSharedInformerFactory(k8sclient, checkLoopTimerSeconds*time.Second)
+
+	if _, err := sharedInformer.Core().V1().Nodes().Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				n, _ := obj.(*v1.Node)
+				if err := m.reconcileNode(ctx, n); err != nil {
+					klog.Errorf("failed to report device state of node %s: %v", n.Name, err)
+				}
+			},
+			UpdateFunc: func(_, obj interface{}) {
+				n, _ := obj.(*v1.Node)
+				if err := m.reconcileNode(ctx, n); err != nil {
+					klog.Errorf("failed to report device state of node %s: %v", n.Name, err)
+				}
+			},
+		},
+	); err != nil {
+		return m, err
+	}
+
+	sharedInformer.Start(stop)
+	sharedInformer.WaitForCacheSync(stop)
+
+	return m, nil
+}
+
+// reconcileNode sets the device state condition of a node from its device
+func (m *deviceStateManager) reconcileNode(ctx context.Context, node *v1.Node) error {
+	if node.Spec.ProviderID == "" {
+		// not initialized yet, so its device is not known
+		return nil
+	}
+	deviceID, err := deviceIDFromProviderID(node.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+	device, err := m.devices.deviceByID(ctx, deviceID)
+	if errors.Is(err, cloudprovider.InstanceNotFound) {
+		// the node is removed by the node lifecycle controller
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return m.updateCondition(ctx, node, device)
+}
+
+// deviceStateCondition returns the node condition reporting the state of a device.
+// It is True when the device is active, and its reason is the device state in CamelCase.
+func deviceStateCondition(device *metal.Device) v1.NodeCondition {
+	state := string(device.GetState())
+	status := v1.ConditionFalse
+	if device.GetState() == metal.DEVICESTATE_ACTIVE {
+		status = v1.ConditionTrue
+	}
+	reason := "Unknown"
+	if state != "" {
+		reason = ""
+		for _, word := range strings.Split(state, "_") {
+			if word != "" {
+				reason += strings.ToUpper(word[:1]) + word[1:]
+			}
+		}
+	}
+	return v1.NodeCondition{
+		Type:    NodeConditionDeviceActive,
+		Status:  status,
+		Reason:  reason,
+		Message: fmt.Sprintf("Equinix Metal device %s is %s", device.GetId(), state),
+	}
+}
+
+// updateCondition sets the device state condition on the node, if it changed
+func (m *deviceStateManager) updateCondition(ctx context.Context, node *v1.Node, device *metal.Device) error {
+	condition := deviceStateCondition(device)
+	for _, c := range node.Status.Conditions {
+		if c.Type == condition.Type && c.Status == condition.Status && c.Reason == condition.Reason && c.Message == condition.Message {
+			return nil
+		}
+	}
+
+	now := metav1.Now()
+	condition.LastHeartbeatTime = now
+	condition.LastTransitionTime = now
+	for _, c := range node.Status.Conditions {
+		if c.Type == condition.Type && c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.NodeCondition{condition},
+		},
+	})
+	if _, err := m.k8sclient.CoreV1().Nodes().Patch(ctx, node.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status"); err != nil {
+		return fmt.Errorf("failed to set condition %s: %w", condition.Type, err)
+	}
+	klog.V(2).Infof("set condition %s of node %s to %s, %s", condition.Type, node.Name, condition.Status, condition.Reason)
+	return nil
+}
@@ -0,0 +1,86 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	"github.com/google/uuid"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDeviceStateCondition(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	devName := testGetNewDevName()
+	uid := uuid.New().String()
+	dev := &metal.Device{
+		Id:       &uid,
+		Hostname: &devName,
+		Plan:     metal.NewPlan(),
+	}
+	server.DeviceStore[uid] = dev
+
+	node := testNode(providerIDFromDevice(dev), devName)
+	k8sclient := k8sfake.NewSimpleClientset(node)
+	devices, err := newDeviceCache(vc.client.DevicesApi, Config{ProjectID: vc.config.ProjectID, DeviceCacheMaxStaleness: "0s"})
+	if err != nil {
+		t.Fatalf("unable to create device cache: %v", err)
+	}
+	m := &deviceStateManager{k8sclient: k8sclient, devices: devices}
+
+	tests := []struct {
+		name    string
+		state   metal.DeviceState
+		status  v1.ConditionStatus
+		reason  string
+		patched bool
+	}{
+		{"powering off", metal.DEVICESTATE_POWERING_OFF, v1.ConditionFalse, "PoweringOff", true},
+		{"unchanged", metal.DEVICESTATE_POWERING_OFF, v1.ConditionFalse, "PoweringOff", false},
+		{"recovered", metal.DEVICESTATE_ACTIVE, v1.ConditionTrue, "Active", true},
+		{"still active", metal.DEVICESTATE_ACTIVE, v1.ConditionTrue, "Active", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev.State = tt.state.Ptr()
+			current, err := k8sclient.CoreV1().Nodes().Get(context.TODO(), devName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unable to get node: %v", err)
+			}
+			k8sclient.ClearActions()
+			if err := m.reconcileNode(context.TODO(), current); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var patched bool
+			for _, action := range k8sclient.Actions() {
+				patched = patched || action.GetVerb() == "patch"
+			}
+			if patched != tt.patched {
+				t.Errorf("mismatched patched, actual %t expected %t", patched, tt.patched)
+			}
+
+			updated, err := k8sclient.CoreV1().Nodes().Get(context.TODO(), devName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unable to get node: %v", err)
+			}
+			var condition *v1.NodeCondition
+			for i := range updated.Status.Conditions {
+				if updated.Status.Conditions[i].Type == NodeConditionDeviceActive {
+					condition = &updated.Status.Conditions[i]
+				}
+			}
+			switch {
+			case condition == nil:
+				t.Fatalf("condition %s not set", NodeConditionDeviceActive)
+			case condition.Status != tt.status:
+				t.Errorf("mismatched status, actual %s expected %s", condition.Status, tt.status)
+			case condition.Reason != tt.reason:
+				t.Errorf("mismatched reason, actual %s expected %s", condition.Reason, tt.reason)
+			}
+		})
+	}
+}
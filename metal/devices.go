@@ -4,25 +4,78 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
 	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	cloudprovider "k8s.io/cloud-provider"
 	cpapi "k8s.io/cloud-provider/api"
 	"k8s.io/klog/v2"
 )
 
+const (
+	// zoneSourceFacility uses the code of the facility the device is in
+	zoneSourceFacility = "facility"
+	// zoneSourceHardwareReservation uses the code of the facility of the device's hardware reservation
+	zoneSourceHardwareReservation = "hardware-reservation"
+	// zoneSourceSwitch uses the UUID of the switch the device is attached to, i.e. its rack
+	zoneSourceSwitch = "switch"
+	// zoneSourceNone disables setting the zone
+	zoneSourceNone = "none"
+)
+
+const (
+	// nodeMatchHostname matches nodes to devices whose hostname is the node name
+	nodeMatchHostname = "hostname"
+	// nodeMatchFQDN matches nodes to devices when one of the node name and the device
+	// hostname is a fully qualified domain name whose first label is the other
+	nodeMatchFQDN = "fqdn"
+	// nodeMatchPrivateIP matches nodes to devices with the private IPv4 address provided to the kubelet with --node-ip
+	nodeMatchPrivateIP = "private-ip"
+	// nodeMatchTag matches nodes to devices tagged with node=<node name>
+	nodeMatchTag = "tag"
+)
+
+var validNodeMatches = []string{nodeMatchHostname, nodeMatchFQDN, nodeMatchPrivateIP, nodeMatchTag}
+
+var validZoneSources = []string{zoneSourceFacility, zoneSourceHardwareReservation, zoneSourceSwitch}
+
 type instances struct {
-	client  *metal.DevicesApiService
-	project string
+	devices               *deviceCache
+	zoneSources           []string
+	primaryIPFamily       v1.IPFamily
+	allowPrivateOnlyNodes bool
+	nodeMatches           []string
 }
 
 var _ cloudprovider.InstancesV2 = (*instances)(nil)
 
-func newInstances(client *metal.DevicesApiService, projectID string) *instances {
-	return &instances{client: client, project: projectID}
+func newInstances(devices *deviceCache, metalConfig Config) (*instances, error) {
+	sources, err := parseZoneSources(metalConfig.ZoneSource)
+	if err != nil {
+		return nil, err
+	}
+	family, err := parseIPFamily(metalConfig.PrimaryIPFamily)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := parseNodeMatches(metalConfig.NodeMatching)
+	if err != nil {
+		return nil, err
+	}
+	return &instances{
+		devices:               devices,
+		zoneSources:           sources,
+		primaryIPFamily:       family,
+		allowPrivateOnlyNodes: metalConfig.AllowPrivateOnlyNodes,
+		nodeMatches:           matches,
+	}, nil
 }
 
 // InstanceShutdown returns true if the node is shutdown in cloudprovider
@@ -32,14 +85,13 @@ func (i *instances) InstanceShutdown(ctx context.Context, node *v1.Node) (bool,
 	if err != nil {
 		return false, err
 	}
-
-	return device.GetState() == metal.DEVICESTATE_INACTIVE, nil
+	return deviceShutdown(device.GetState()), nil
 }
 
 // InstanceExists returns true if the node exists in cloudprovider
 func (i *instances) InstanceExists(ctx context.Context, node *v1.Node) (bool, error) {
 	klog.V(2).Infof("called InstanceExists for node %s with providerID %s", node.GetName(), node.Spec.ProviderID)
-	_, err := i.deviceFromProviderID(node.Spec.ProviderID)
+	device, err := i.deviceFromProviderID(node.Spec.ProviderID)
 
 	switch {
 	case errors.Is(err, cloudprovider.InstanceNotFound):
@@ -48,7 +100,7 @@ func (i *instances) InstanceExists(ctx context.Context, node *v1.Node) (bool, er
 		return false, err
 	}
 
-	return true, nil
+	return deviceExists(device.GetState()), nil
 }
 
 // InstanceMetadata returns instancemetadata for the node according to the cloudprovider
@@ -62,15 +114,13 @@ func (i *instances) InstanceMetadata(ctx context.Context, node *v1.Node) (*cloud
 	if node.Annotations != nil {
 		providedNodeIP = node.Annotations[cpapi.AnnotationAlphaProvidedIPAddr]
 	}
-	nodeAddresses, err := nodeAddresses(device, providedNodeIP)
+	nodeAddresses, err := nodeAddresses(device, providedNodeIP, i.primaryIPFamily, i.allowPrivateOnlyNodes)
 	if err != nil {
-		// TODO(displague) we error on missing private and public ip. is that restrictive?
-
 		// TODO(displague) should we return the public addresses DNS name as the Type=Hostname NodeAddress type too?
 		return nil, err
 	}
 
-	var p, r, z string
+	var p, r string
 	if device.Plan != nil {
 		p = device.Plan.GetSlug()
 	}
@@ -80,23 +130,168 @@ func (i *instances) InstanceMetadata(ctx context.Context, node *v1.Node) (*cloud
 	//
 	// Equinix Metal metros are made up of one or more facilities, so we treat
 	// metros as K8s topology regions. EM facilities are then equated to zones.
+	// As facilities are retired in favour of metros, the zone can instead
+	// be derived from the hardware reservation or the rack, see deviceZone.
 	//
 	// https://kubernetes.io/docs/reference/labels-annotations-taints/#topologykubernetesiozone
 
 	if device.Metro != nil {
 		r = device.Metro.GetCode()
 	}
+	z := deviceZone(device, i.zoneSources)
 
 	return &cloudprovider.InstanceMetadata{
-		ProviderID:    providerIDFromDevice(device),
-		InstanceType:  p,
-		NodeAddresses: nodeAddresses,
-		Zone:          z,
-		Region:        r,
+		ProviderID:       providerIDFromDevice(device),
+		InstanceType:     p,
+		NodeAddresses:    nodeAddresses,
+		Zone:             z,
+		Region:           r,
+		AdditionalLabels: deviceLabels(device),
 	}, nil
 }
 
-func nodeAddresses(device *metal.Device, providedNodeIP string) ([]v1.NodeAddress, error) {
+// deviceExists returns false for devices that are being, or have been, deleted, so that
+// their nodes are removed, and true for any other state.
+func deviceExists(state metal.DeviceState) bool {
+	switch state {
+	case metal.DEVICESTATE_DEPROVISIONING, metal.DEVICESTATE_DELETED:
+		return false
+	default:
+		return true
+	}
+}
+
+// deviceShutdown returns true for devices that are powered off or powering off, being reinstalled,
+// failed, or being deleted. Any other state, including those of devices that are coming up, is treated
+// as running, so that nodes are not tainted unexpectedly.
+func deviceShutdown(state metal.DeviceState) bool {
+	switch state {
+	case metal.DEVICESTATE_INACTIVE,
+		metal.DEVICESTATE_POWERING_OFF,
+		metal.DEVICESTATE_REINSTALLING,
+		metal.DEVICESTATE_FAILED,
+		metal.DEVICESTATE_DEPROVISIONING:
+		return true
+	default:
+		return false
+	}
+}
+
+// deviceLabels returns the node labels describing a device. Labels for which
+// the device has no value, or whose value is not a valid label value, are omitted.
+func deviceLabels(device *metal.Device) map[string]string {
+	labels := map[string]string{
+		LabelSpotInstance: strconv.FormatBool(device.GetSpotInstance()),
+		LabelBillingCycle: string(device.GetBillingCycle()),
+		LabelNetworkMode:  deviceNetworkMode(device),
+	}
+	if device.OperatingSystem != nil {
+		labels[LabelOperatingSystem] = device.OperatingSystem.GetSlug()
+	}
+	if device.Plan != nil {
+		labels[LabelPlanClass] = device.Plan.GetClass()
+	}
+	if device.HardwareReservation != nil {
+		labels[LabelHardwareReservationID] = device.HardwareReservation.GetId()
+	}
+
+	for k, v := range labels {
+		if v == "" {
+			delete(labels, k)
+			continue
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			klog.V(2).Infof("skipping label %s for device %s, invalid value %q: %s", k, device.GetId(), v, strings.Join(errs, "; "))
+			delete(labels, k)
+		}
+	}
+	return labels
+}
+
+// deviceNetworkMode returns the network mode of a device, e.g. layer3, hybrid or layer2-bonded,
+// as reported on its bond port. Devices without a bond port report the type of their first port that has one.
+func deviceNetworkMode(device *metal.Device) string {
+	var mode string
+	for _, port := range device.GetNetworkPorts() {
+		if port.GetType() == metal.PORTTYPE_NETWORK_BOND_PORT && port.GetNetworkType() != "" {
+			return string(port.GetNetworkType())
+		}
+		if mode == "" {
+			mode = string(port.GetNetworkType())
+		}
+	}
+	return mode
+}
+
+// deviceZone returns the zone for a device, using the first of the sources
+// that yields a non-empty value. An empty string means no zone could be determined.
+func deviceZone(device *metal.Device, sources []string) string {
+	for _, source := range sources {
+		var z string
+		switch source {
+		case zoneSourceFacility:
+			if device.Facility != nil {
+				z = device.Facility.GetCode()
+			}
+		case zoneSourceHardwareReservation:
+			if device.HardwareReservation != nil && device.HardwareReservation.Facility != nil {
+				z = device.HardwareReservation.Facility.GetCode()
+			}
+		case zoneSourceSwitch:
+			z = device.GetSwitchUuid()
+		}
+		if z != "" {
+			return z
+		}
+	}
+	return ""
+}
+
+// parseZoneSources parses a comma-separated list of zone sources. The value
+// "none" disables zones entirely, and an empty value returns the default.
+func parseZoneSources(setting string) ([]string, error) {
+	setting = strings.TrimSpace(setting)
+	switch setting {
+	case "":
+		setting = DefaultZoneSource
+	case zoneSourceNone:
+		return nil, nil
+	}
+	var sources []string
+	for _, source := range strings.Split(setting, ",") {
+		source = strings.TrimSpace(source)
+		if !slices.Contains(validZoneSources, source) {
+			return nil, fmt.Errorf("invalid zone source %q", source)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// parseIPFamily parses an IP family setting, case-insensitively. An empty value returns IPv4.
+func parseIPFamily(setting string) (v1.IPFamily, error) {
+	switch {
+	case setting == "", strings.EqualFold(setting, string(v1.IPv4Protocol)):
+		return v1.IPv4Protocol, nil
+	case strings.EqualFold(setting, string(v1.IPv6Protocol)):
+		return v1.IPv6Protocol, nil
+	default:
+		return "", fmt.Errorf("invalid IP family %q, must be one of %s or %s", setting, v1.IPv4Protocol, v1.IPv6Protocol)
+	}
+}
+
+// nodeAddresses returns the addresses of a device as node addresses. The hostname always
+// is first, followed by the kubelet-provided node IP, if any, and then the device's addresses.
+// Device addresses are ordered so that the primary IP family comes first, internal before
+// external within a family, and management addresses before others; ties are broken by
+// the address itself, so the result does not depend on the order returned by the API.
+//
+// Normally a device must have at least one private and one public address. If allowPrivateOnly
+// is set, devices without a public address are accepted, as are layer2 devices, for which the
+// Equinix Metal management addresses are ignored, as they are not configured on the host. The
+// internal address of such devices comes from other addresses assigned to the device, such as
+// VRF addresses, or from the kubelet-provided node IP, which is how VLAN addresses are supplied.
+func nodeAddresses(device *metal.Device, providedNodeIP string, primaryFamily v1.IPFamily, allowPrivateOnly bool) ([]v1.NodeAddress, error) {
 	var (
 		addresses           []v1.NodeAddress
 		unique              = map[string]bool{}
@@ -115,76 +310,181 @@ func nodeAddresses(device *metal.Device, providedNodeIP string) ([]v1.NodeAddres
 			addresses = append(addresses, addr)
 		}
 	}
+
+	layer2 := allowPrivateOnly && isLayer2NetworkMode(deviceNetworkMode(device))
+	deviceAddresses := make([]metal.IPAssignment, 0, len(device.IpAddresses))
 	for _, address := range device.IpAddresses {
-		if address.GetAddressFamily() == int32(metal.IPADDRESSADDRESSFAMILY__4) {
-			var addrType v1.NodeAddressType
-			if address.GetPublic() {
-				publicIP = address.GetAddress()
-				addrType = v1.NodeExternalIP
-			} else {
-				privateIP = address.GetAddress()
-				addrType = v1.NodeInternalIP
-			}
-			addr = v1.NodeAddress{Type: addrType, Address: address.GetAddress()}
+		if layer2 && address.GetManagement() {
+			klog.V(2).Infof("skipping management address %s on layer2 device %s", address.GetAddress(), device.GetId())
+			continue
+		}
+		family := address.GetAddressFamily()
+		if family != int32(metal.IPADDRESSADDRESSFAMILY__4) && family != int32(metal.IPADDRESSADDRESSFAMILY__6) {
+			continue
+		}
+		if _, err := netip.ParseAddr(address.GetAddress()); err != nil {
+			klog.V(2).Infof("skipping invalid address %q on device %s: %v", address.GetAddress(), device.GetId(), err)
+			continue
+		}
+		deviceAddresses = append(deviceAddresses, address)
+	}
+	sort.SliceStable(deviceAddresses, func(i, j int) bool {
+		a, b := deviceAddresses[i], deviceAddresses[j]
+		if ra, rb := ipFamilyRank(a, primaryFamily), ipFamilyRank(b, primaryFamily); ra != rb {
+			return ra < rb
+		}
+		if a.GetPublic() != b.GetPublic() {
+			return !a.GetPublic()
+		}
+		if a.GetManagement() != b.GetManagement() {
+			return a.GetManagement()
+		}
+		return netip.MustParseAddr(a.GetAddress()).Less(netip.MustParseAddr(b.GetAddress()))
+	})
+
+	for _, address := range deviceAddresses {
+		var addrType v1.NodeAddressType
+		if address.GetPublic() {
+			publicIP = address.GetAddress()
+			addrType = v1.NodeExternalIP
+		} else {
+			privateIP = address.GetAddress()
+			addrType = v1.NodeInternalIP
+		}
+		addr = v1.NodeAddress{Type: addrType, Address: address.GetAddress()}
 
-			if _, ok := unique[addr.Address]; !ok {
-				unique[addr.Address] = true
-				addresses = append(addresses, addr)
-			}
+		if _, ok := unique[addr.Address]; !ok {
+			unique[addr.Address] = true
+			addresses = append(addresses, addr)
 		}
 	}
 
 	if privateIP == "" {
+		if allowPrivateOnly {
+			return nil, errors.New("could not get at least one private ip, set one with the kubelet --node-ip flag")
+		}
 		return nil, errors.New("could not get at least one private ip")
 	}
 
-	if publicIP == "" {
+	if publicIP == "" && !allowPrivateOnly {
 		return nil, errors.New("could not get at least one public ip")
 	}
 
 	return addresses, nil
 }
 
+// isLayer2NetworkMode returns true if the network mode is one of the layer2 modes,
+// in which the device has no Equinix Metal managed layer3 networking
+func isLayer2NetworkMode(mode string) bool {
+	return mode == string(metal.PORTNETWORKTYPE_LAYER2_BONDED) || mode == string(metal.PORTNETWORKTYPE_LAYER2_INDIVIDUAL)
+}
+
+// ipFamilyRank returns 0 if the address is of the primary family, else 1
+func ipFamilyRank(address metal.IPAssignment, primaryFamily v1.IPFamily) int {
+	family := v1.IPv4Protocol
+	if address.GetAddressFamily() == int32(metal.IPADDRESSADDRESSFAMILY__6) {
+		family = v1.IPv6Protocol
+	}
+	if family == primaryFamily {
+		return 0
+	}
+	return 1
+}
+
 func (i *instances) deviceByNode(node *v1.Node) (*metal.Device, error) {
 	if node.Spec.ProviderID != "" {
 		return i.deviceFromProviderID(node.Spec.ProviderID)
 	}
 
-	return deviceByName(i.client, i.project, types.NodeName(node.GetName()))
-}
-
-func deviceByID(client *metal.DevicesApiService, id string) (*metal.Device, error) {
-	klog.V(2).Infof("called deviceByID with ID %s", id)
-	device, resp, err := client.FindDeviceById(context.Background(), id).Execute()
-	if isNotFound(resp, err) {
-		return nil, cloudprovider.InstanceNotFound
-	}
-	return device, err
+	return i.deviceByName(node)
 }
 
-// deviceByName returns an instance whose hostname matches the kubernetes node.Name
-func deviceByName(client *metal.DevicesApiService, projectID string, nodeName types.NodeName) (*metal.Device, error) {
-	klog.V(2).Infof("called deviceByName with projectID %s nodeName %s", projectID, nodeName)
+// deviceByName returns an instance matching the kubernetes node, trying each of the
+// configured node matches in order
+func (i *instances) deviceByName(node *v1.Node) (*metal.Device, error) {
+	nodeName := types.NodeName(node.GetName())
+	klog.V(2).Infof("called deviceByName with nodeName %s", nodeName)
 	if string(nodeName) == "" {
 		return nil, errors.New("node name cannot be empty string")
 	}
-	devices, _, err := client.FindProjectDevices(context.Background(), projectID).Execute()
-	if err != nil {
-		klog.V(2).Infof("error listing devices for project %s: %v", projectID, err)
-		return nil, err
-	}
-
-	for _, device := range devices.GetDevices() {
-		if device.GetHostname() == string(nodeName) {
-			klog.V(2).Infof("Found device %s for nodeName %s", device.GetId(), nodeName)
-			return &device, nil
+	for _, match := range i.nodeMatches {
+		matcher := nodeMatcher(match, node)
+		if matcher == nil {
+			continue
+		}
+		device, err := i.devices.deviceMatching(context.Background(), matcher)
+		if errors.Is(err, cloudprovider.InstanceNotFound) {
+			continue
 		}
+		if err != nil {
+			return nil, err
+		}
+		klog.V(2).Infof("Found device %s for nodeName %s by %s", device.GetId(), nodeName, match)
+		return device, nil
 	}
 
 	klog.V(2).Infof("No device found for nodeName %s", nodeName)
 	return nil, cloudprovider.InstanceNotFound
 }
 
+// nodeMatcher returns a function reporting whether a device matches the node, according to
+// the given node match, or nil if the node does not have what the match needs
+func nodeMatcher(match string, node *v1.Node) func(*metal.Device) bool {
+	nodeName := node.GetName()
+	switch match {
+	case nodeMatchHostname:
+		return func(device *metal.Device) bool {
+			return device.GetHostname() == nodeName
+		}
+	case nodeMatchFQDN:
+		return func(device *metal.Device) bool {
+			hostname := device.GetHostname()
+			return hostname != "" && (strings.HasPrefix(nodeName, hostname+".") || strings.HasPrefix(hostname, nodeName+"."))
+		}
+	case nodeMatchPrivateIP:
+		providedNodeIP := node.Annotations[cpapi.AnnotationAlphaProvidedIPAddr]
+		if providedNodeIP == "" {
+			return nil
+		}
+		return func(device *metal.Device) bool {
+			for _, address := range device.GetIpAddresses() {
+				if !address.GetPublic() && address.GetAddressFamily() == int32(metal.IPADDRESSADDRESSFAMILY__4) && address.GetAddress() == providedNodeIP {
+					return true
+				}
+			}
+			return false
+		}
+	case nodeMatchTag:
+		tag := nodeTag(nodeName)
+		return func(device *metal.Device) bool {
+			return slices.Contains(device.GetTags(), tag)
+		}
+	default:
+		return nil
+	}
+}
+
+func nodeTag(nodeName string) string {
+	return fmt.Sprintf("node=%s", nodeName)
+}
+
+// parseNodeMatches parses a comma-separated list of node matches. An empty value returns the default.
+func parseNodeMatches(setting string) ([]string, error) {
+	setting = strings.TrimSpace(setting)
+	if setting == "" {
+		setting = DefaultNodeMatching
+	}
+	var matches []string
+	for _, match := range strings.Split(setting, ",") {
+		match = strings.TrimSpace(match)
+		if !slices.Contains(validNodeMatches, match) {
+			return nil, fmt.Errorf("invalid node match %q", match)
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
 // deviceIDFromProviderID returns a device's ID from providerID.
 //
 // The providerID spec should be retrievable from the Kubernetes
@@ -220,7 +520,7 @@ func (i *instances) deviceFromProviderID(providerID string) (*metal.Device, erro
 		return nil, err
 	}
 
-	return deviceByID(i.client, id)
+	return i.devices.deviceByID(context.Background(), id)
 }
 
 // providerIDFromDevice returns a providerID from a device
@@ -2,7 +2,9 @@ package metal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -10,7 +12,9 @@ import (
 	"github.com/google/uuid"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cloudprovider "k8s.io/cloud-provider"
 	cpapi "k8s.io/cloud-provider/api"
+	"k8s.io/utils/ptr"
 )
 
 // testNode provides a simple Node object satisfying the lookup requirements of InstanceMetadata()
@@ -67,6 +71,7 @@ func TestNodeAddresses(t *testing.T) {
 		{Type: v1.NodeHostName, Address: devName},
 		{Type: v1.NodeInternalIP, Address: networks[0].GetAddress()},
 		{Type: v1.NodeExternalIP, Address: networks[1].GetAddress()},
+		{Type: v1.NodeExternalIP, Address: networks[2].GetAddress()},
 	}
 
 	validAddressesWithProvidedIP := []v1.NodeAddress{
@@ -74,6 +79,7 @@ func TestNodeAddresses(t *testing.T) {
 		{Type: v1.NodeInternalIP, Address: kubeletNodeIP.GetAddress()},
 		{Type: v1.NodeInternalIP, Address: networks[0].GetAddress()},
 		{Type: v1.NodeExternalIP, Address: networks[1].GetAddress()},
+		{Type: v1.NodeExternalIP, Address: networks[2].GetAddress()},
 	}
 
 	tests := []struct {
@@ -139,6 +145,7 @@ func TestNodeAddressesByProviderID(t *testing.T) {
 		{Type: v1.NodeHostName, Address: devName},
 		{Type: v1.NodeInternalIP, Address: networks[0].GetAddress()},
 		{Type: v1.NodeExternalIP, Address: networks[1].GetAddress()},
+		{Type: v1.NodeExternalIP, Address: networks[2].GetAddress()},
 	}
 
 	tests := []struct {
@@ -174,6 +181,134 @@ func TestNodeAddressesByProviderID(t *testing.T) {
 	}
 }
 
+func TestNodeAddressesOrdering(t *testing.T) {
+	devName := testGetNewDevName()
+	trueBool, falseBool := true, false
+	ipv4, ipv6 := int32(metal.IPADDRESSADDRESSFAMILY__4), int32(metal.IPADDRESSADDRESSFAMILY__6)
+	address := func(addr string, family int32, public, management bool) metal.IPAssignment {
+		a := metal.IPAssignment{Address: &addr, AddressFamily: &family, Public: &falseBool, Management: &falseBool}
+		if public {
+			a.Public = &trueBool
+		}
+		if management {
+			a.Management = &trueBool
+		}
+		return a
+	}
+	dev := &metal.Device{
+		Hostname: &devName,
+		IpAddresses: []metal.IPAssignment{
+			address("2604:1380:4641:c500::3", ipv6, true, true),
+			address("145.40.77.11", ipv4, true, true),
+			address("10.70.12.9", ipv4, false, false),
+			address("fdaa:1::5", ipv6, false, false),
+			address("10.70.12.3", ipv4, false, true),
+			address("145.40.77.2", ipv4, true, false),
+		},
+	}
+
+	tests := []struct {
+		name      string
+		family    v1.IPFamily
+		addresses []v1.NodeAddress
+	}{
+		{"ipv4 primary", v1.IPv4Protocol, []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: devName},
+			{Type: v1.NodeInternalIP, Address: "10.70.12.3"},
+			{Type: v1.NodeInternalIP, Address: "10.70.12.9"},
+			{Type: v1.NodeExternalIP, Address: "145.40.77.11"},
+			{Type: v1.NodeExternalIP, Address: "145.40.77.2"},
+			{Type: v1.NodeInternalIP, Address: "fdaa:1::5"},
+			{Type: v1.NodeExternalIP, Address: "2604:1380:4641:c500::3"},
+		}},
+		{"ipv6 primary", v1.IPv6Protocol, []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: devName},
+			{Type: v1.NodeInternalIP, Address: "fdaa:1::5"},
+			{Type: v1.NodeExternalIP, Address: "2604:1380:4641:c500::3"},
+			{Type: v1.NodeInternalIP, Address: "10.70.12.3"},
+			{Type: v1.NodeInternalIP, Address: "10.70.12.9"},
+			{Type: v1.NodeExternalIP, Address: "145.40.77.11"},
+			{Type: v1.NodeExternalIP, Address: "145.40.77.2"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addresses, err := nodeAddresses(dev, "", tt.family, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !compareAddresses(addresses, tt.addresses) {
+				t.Errorf("mismatched addresses, actual %v expected %v", addresses, tt.addresses)
+			}
+		})
+	}
+}
+
+func TestNodeAddressesPrivateOnly(t *testing.T) {
+	devName := testGetNewDevName()
+	trueBool, falseBool := true, false
+	ipv4 := int32(metal.IPADDRESSADDRESSFAMILY__4)
+	managementIP, vrfIP, kubeletIP := "10.70.12.3", "192.168.100.5", "172.16.0.10"
+	bondType := metal.PORTTYPE_NETWORK_BOND_PORT
+	layer2 := metal.PORTNETWORKTYPE_LAYER2_BONDED
+
+	privateOnly := &metal.Device{
+		Hostname: &devName,
+		IpAddresses: []metal.IPAssignment{
+			{Address: &managementIP, AddressFamily: &ipv4, Public: &falseBool, Management: &trueBool},
+		},
+	}
+	layer2Device := &metal.Device{
+		Hostname: &devName,
+		IpAddresses: []metal.IPAssignment{
+			{Address: &managementIP, AddressFamily: &ipv4, Public: &falseBool, Management: &trueBool},
+			{Address: &vrfIP, AddressFamily: &ipv4, Public: &falseBool, Management: &falseBool},
+		},
+		NetworkPorts: []metal.Port{{Type: &bondType, NetworkType: &layer2}},
+	}
+	noAddresses := &metal.Device{
+		Hostname:     &devName,
+		NetworkPorts: []metal.Port{{Type: &bondType, NetworkType: &layer2}},
+	}
+
+	tests := []struct {
+		name             string
+		device           *metal.Device
+		providedNodeIP   string
+		allowPrivateOnly bool
+		addresses        []v1.NodeAddress
+		err              error
+	}{
+		{"private only disallowed", privateOnly, "", false, nil, fmt.Errorf("could not get at least one public ip")},
+		{"private only allowed", privateOnly, "", true, []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: devName},
+			{Type: v1.NodeInternalIP, Address: managementIP},
+		}, nil},
+		{"layer2 uses vrf address", layer2Device, "", true, []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: devName},
+			{Type: v1.NodeInternalIP, Address: vrfIP},
+		}, nil},
+		{"layer2 with kubelet ip", noAddresses, kubeletIP, true, []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: devName},
+			{Type: v1.NodeInternalIP, Address: kubeletIP},
+		}, nil},
+		{"layer2 without any ip", noAddresses, "", true, nil, fmt.Errorf("could not get at least one private ip")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addresses, err := nodeAddresses(tt.device, tt.providedNodeIP, v1.IPv4Protocol, tt.allowPrivateOnly)
+			switch {
+			case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+				t.Errorf("mismatched errors, actual %v expected %v", err, tt.err)
+			case !compareAddresses(addresses, tt.addresses):
+				t.Errorf("mismatched addresses, actual %v expected %v", addresses, tt.addresses)
+			}
+		})
+	}
+}
+
 /*
 	func TestInstanceID(t *testing.T) {
 		vc, server := testGetValidCloud(t, "")
@@ -294,6 +429,8 @@ func TestInstanceZone(t *testing.T) {
 	country := "Country"
 	metro := &metal.DeviceMetro{Id: &metroId, Code: &regionCode, Name: &regionName, Country: &country}
 	dev.Metro = metro
+	zoneCode := validZoneCode
+	dev.Facility = &metal.Facility{Code: &zoneCode}
 
 	trueBool := true
 	ipv4 := int32(metal.IPADDRESSADDRESSFAMILY__4)
@@ -319,25 +456,122 @@ func TestInstanceZone(t *testing.T) {
 		testName string
 		name     string
 		region   string
+		zone     string
 		err      error
 	}{
-		{"empty name", "", "", fmt.Errorf("instance not found")},
-		{"unknown name", randomID, "", fmt.Errorf("instance not found")},
-		{"valid", "equinixmetal://" + dev.GetId(), validRegionCode, nil},
+		{"empty name", "", "", "", fmt.Errorf("instance not found")},
+		{"unknown name", randomID, "", "", fmt.Errorf("instance not found")},
+		{"valid", "equinixmetal://" + dev.GetId(), validRegionCode, validZoneCode, nil},
 	}
 
 	for i, tt := range tests {
 		t.Run(tt.testName, func(t *testing.T) {
-			var region string
+			var region, zone string
 			md, err := inst.InstanceMetadata(context.TODO(), testNode(tt.name, nodeName))
 			if md != nil {
 				region = md.Region
+				zone = md.Zone
 			}
 			switch {
 			case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 				t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
 			case region != tt.region:
 				t.Errorf("%d: mismatched region, actual %v expected %v", i, region, tt.region)
+			case zone != tt.zone:
+				t.Errorf("%d: mismatched zone, actual %v expected %v", i, zone, tt.zone)
+			}
+		})
+	}
+}
+
+func TestDeviceZone(t *testing.T) {
+	facility := "da11"
+	reservationFacility := "da12"
+	switchUUID := uuid.New().String()
+
+	withFacility := &metal.Device{Facility: &metal.Facility{Code: &facility}}
+	withReservation := &metal.Device{
+		HardwareReservation: &metal.HardwareReservation{Facility: &metal.Facility{Code: &reservationFacility}},
+		SwitchUuid:          &switchUUID,
+	}
+	empty := &metal.Device{}
+
+	tests := []struct {
+		name    string
+		device  *metal.Device
+		setting string
+		zone    string
+		err     bool
+	}{
+		{"default with facility", withFacility, "", facility, false},
+		{"default falls back to reservation", withReservation, "", reservationFacility, false},
+		{"default with nothing", empty, "", "", false},
+		{"switch only", withReservation, "switch", switchUUID, false},
+		{"facility then switch", withReservation, "facility,switch", switchUUID, false},
+		{"none", withFacility, "none", "", false},
+		{"invalid", withFacility, "facility,rack", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, err := parseZoneSources(tt.setting)
+			if (err != nil) != tt.err {
+				t.Fatalf("mismatched errors, actual %v expected error %v", err, tt.err)
+			}
+			if zone := deviceZone(tt.device, sources); zone != tt.zone {
+				t.Errorf("mismatched zone, actual %q expected %q", zone, tt.zone)
+			}
+		})
+	}
+}
+
+func TestDeviceLabels(t *testing.T) {
+	reservationID := uuid.New().String()
+	planClass := "c3.small.x86"
+	osSlug := "ubuntu_22_04"
+	billing := "hourly"
+	bondName, ethName := "bond0", "eth0"
+	bondType, ethType := metal.PORTTYPE_NETWORK_BOND_PORT, metal.PORTTYPE_NETWORK_PORT
+	hybrid, layer3 := metal.PORTNETWORKTYPE_HYBRID, metal.PORTNETWORKTYPE_LAYER3
+	invalid := "not a valid label value"
+
+	tests := []struct {
+		name   string
+		device *metal.Device
+		labels map[string]string
+	}{
+		{"empty device", &metal.Device{}, map[string]string{
+			LabelSpotInstance: "false",
+		}},
+		{"full device", &metal.Device{
+			Plan:                &metal.Plan{Class: &planClass},
+			HardwareReservation: &metal.HardwareReservation{Id: &reservationID},
+			SpotInstance:        ptr.To(true),
+			OperatingSystem:     &metal.OperatingSystem{Slug: &osSlug},
+			BillingCycle:        &billing,
+			NetworkPorts: []metal.Port{
+				{Name: &ethName, Type: &ethType, NetworkType: &layer3},
+				{Name: &bondName, Type: &bondType, NetworkType: &hybrid},
+			},
+		}, map[string]string{
+			LabelPlanClass:             planClass,
+			LabelHardwareReservationID: reservationID,
+			LabelSpotInstance:          "true",
+			LabelOperatingSystem:       osSlug,
+			LabelNetworkMode:           string(hybrid),
+			LabelBillingCycle:          billing,
+		}},
+		{"invalid value skipped", &metal.Device{
+			OperatingSystem: &metal.OperatingSystem{Slug: &invalid},
+		}, map[string]string{
+			LabelSpotInstance: "false",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if labels := deviceLabels(tt.device); !reflect.DeepEqual(labels, tt.labels) {
+				t.Errorf("mismatched labels, actual %v expected %v", labels, tt.labels)
 			}
 		})
 	}
@@ -521,6 +755,117 @@ func TestInstanceShutdownByProviderID(t *testing.T) {
 	}
 }
 
+func TestDeviceStates(t *testing.T) {
+	tests := []struct {
+		state    metal.DeviceState
+		exists   bool
+		shutdown bool
+	}{
+		{metal.DEVICESTATE_ACTIVE, true, false},
+		{metal.DEVICESTATE_QUEUED, true, false},
+		{metal.DEVICESTATE_PROVISIONING, true, false},
+		{metal.DEVICESTATE_REINSTALLING, true, true},
+		{metal.DEVICESTATE_INACTIVE, true, true},
+		{metal.DEVICESTATE_POWERING_ON, true, false},
+		{metal.DEVICESTATE_POWERING_OFF, true, true},
+		{metal.DEVICESTATE_FAILED, true, true},
+		{metal.DEVICESTATE_DEPROVISIONING, false, true},
+		{metal.DEVICESTATE_DELETED, false, false},
+		{metal.DeviceState("unknown"), true, false},
+	}
+
+	for _, tt := range tests {
+		if exists := deviceExists(tt.state); exists != tt.exists {
+			t.Errorf("%s: mismatched exists, actual %v expected %v", tt.state, exists, tt.exists)
+		}
+		if shutdown := deviceShutdown(tt.state); shutdown != tt.shutdown {
+			t.Errorf("%s: mismatched shutdown, actual %v expected %v", tt.state, shutdown, tt.shutdown)
+		}
+	}
+}
+
+func TestDeviceByNodeMatching(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	devName := testGetNewDevName()
+	uid := uuid.New().String()
+	privateIP := testCreateAddress(false, false)
+	dev := &metal.Device{
+		Id:          &uid,
+		Hostname:    &devName,
+		Tags:        []string{"other", nodeTag("custom-node")},
+		IpAddresses: []metal.IPAssignment{privateIP, testCreateAddress(false, true)},
+	}
+	server.DeviceStore[uid] = dev
+	project := server.ProjectStore[vc.config.ProjectID]
+	project.Devices = append(project.Devices, dev)
+	server.ProjectStore[vc.config.ProjectID] = project
+
+	tests := []struct {
+		matching string
+		node     *v1.Node
+		found    bool
+	}{
+		{"hostname", testNode("", devName), true},
+		{"hostname", testNode("", devName+".example.com"), false},
+		{"fqdn", testNode("", devName+".example.com"), true},
+		{"fqdn", testNode("", devName+"0.example.com"), false},
+		{"hostname,fqdn", testNode("", devName+".example.com"), true},
+		{"private-ip", testNodeWithIP("", "other-node", privateIP.GetAddress()), true},
+		{"private-ip", testNodeWithIP("", "other-node", "10.255.255.254"), false},
+		{"private-ip", testNode("", "other-node"), false},
+		{"tag", testNode("", "custom-node"), true},
+		{"tag", testNode("", "other"), false},
+		{"hostname,tag", testNode("", "custom-node"), true},
+	}
+
+	for i, tt := range tests {
+		config := vc.config
+		config.NodeMatching = tt.matching
+		devices, err := newDeviceCache(vc.client.DevicesApi, config)
+		if err != nil {
+			t.Fatalf("unable to create device cache: %v", err)
+		}
+		inst, err := newInstances(devices, config)
+		if err != nil {
+			t.Fatalf("unable to create instances: %v", err)
+		}
+		device, err := inst.deviceByNode(tt.node)
+		switch {
+		case tt.found && err != nil:
+			t.Errorf("%d: unexpected error for %s matching %s: %v", i, tt.node.Name, tt.matching, err)
+		case tt.found && device.GetId() != uid:
+			t.Errorf("%d: mismatched device, actual %s expected %s", i, device.GetId(), uid)
+		case !tt.found && !errors.Is(err, cloudprovider.InstanceNotFound):
+			t.Errorf("%d: mismatched error for %s matching %s, actual %v expected %v", i, tt.node.Name, tt.matching, err, cloudprovider.InstanceNotFound)
+		}
+	}
+}
+
+func TestParseNodeMatches(t *testing.T) {
+	tests := []struct {
+		setting string
+		matches []string
+		valid   bool
+	}{
+		{"", []string{"hostname"}, true},
+		{"hostname", []string{"hostname"}, true},
+		{"tag, private-ip,fqdn", []string{"tag", "private-ip", "fqdn"}, true},
+		{"hostname,unknown", nil, false},
+	}
+
+	for i, tt := range tests {
+		matches, err := parseNodeMatches(tt.setting)
+		switch {
+		case err != nil && tt.valid:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case err == nil && !tt.valid:
+			t.Errorf("%d: expected error, got %v", i, matches)
+		case !reflect.DeepEqual(matches, tt.matches):
+			t.Errorf("%d: mismatched matches, actual %v expected %v", i, matches, tt.matches)
+		}
+	}
+}
+
 func compareAddresses(a1, a2 []v1.NodeAddress) bool {
 	switch {
 	case (a1 == nil && a2 != nil) || (a1 != nil && a2 == nil):
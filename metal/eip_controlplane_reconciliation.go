@@ -19,6 +19,7 @@ import (
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	discoveryv1 "k8s.io/api/discovery/v1"
 	discoveryv1applyconfig "k8s.io/client-go/applyconfigurations/discovery/v1"
@@ -59,6 +60,7 @@ type controlPlaneEndpointManager struct {
 	projectID             string
 	httpClient            *http.Client
 	k8sclient             kubernetes.Interface
+	recorder              record.EventRecorder
 	assignmentMutex       sync.Mutex
 	serviceMutex          sync.Mutex
 	endpointsMutex        sync.Mutex
@@ -66,7 +68,7 @@ type controlPlaneEndpointManager struct {
 	useHostIP             bool
 }
 
-func newControlPlaneEndpointManager(k8sclient kubernetes.Interface, stop <-chan struct{}, eipTag, projectID string, client *metal.APIClient, apiServerPort int32, useHostIP bool) (*controlPlaneEndpointManager, error) {
+func newControlPlaneEndpointManager(k8sclient kubernetes.Interface, recorder record.EventRecorder, stop <-chan struct{}, eipTag, projectID string, client *metal.APIClient, apiServerPort int32, useHostIP bool) (*controlPlaneEndpointManager, error) {
 	klog.V(2).Info("newControlPlaneEndpointManager()")
 
 	if eipTag == "" {
@@ -86,6 +88,7 @@ func newControlPlaneEndpointManager(k8sclient kubernetes.Interface, stop <-chan
 		apiClient:     client,
 		apiServerPort: apiServerPort,
 		k8sclient:     k8sclient,
+		recorder:      recorder,
 		useHostIP:     useHostIP,
 	}
 
@@ -283,6 +286,7 @@ func (m *controlPlaneEndpointManager) reassign(_ context.Context, nodes []*v1.No
 					return err
 				}
 				klog.Infof("control plane endpoint assigned to new device %s", node.Name)
+				m.recorder.Eventf(node, v1.EventTypeNormal, eventReasonControlPlaneEIPReassigned, "Control plane endpoint %s assigned to node", ip.GetAddress())
 				return nil
 			}
 			klog.Infof("will not assign control plane endpoint to new device %s: returned http code %d", node.Name, resp.StatusCode)
@@ -302,7 +306,7 @@ func isControlPlaneNode(node *v1.Node) bool {
 }
 
 func (m *controlPlaneEndpointManager) getControlPlaneEndpointReservation() (*metal.IPReservation, error) {
-	ipList, _, err := m.apiClient.IPAddressesApi.FindIPReservations(context.Background(), m.projectID).Include([]string{"assignments"}).Execute()
+	ipList, err := listIPReservations(context.Background(), m.apiClient, m.projectID, "assignments")
 	if err != nil {
 		return nil, err
 	}
@@ -422,7 +426,9 @@ func (m *controlPlaneEndpointManager) tryReassign(ctx context.Context, controlPl
 
 	potentialNodes := nodeSet.filter(filters...).toList()
 
-	if err := m.reassign(ctx, potentialNodes, controlPlaneEndpoint, controlPlaneHealthURL); err != nil {
+	err := m.reassign(ctx, potentialNodes, controlPlaneEndpoint, controlPlaneHealthURL)
+	controlPlaneFailovers.WithLabelValues(result(err)).Inc()
+	if err != nil {
 		return fmt.Errorf("failed to assign the control plane endpoint: %w", err)
 	}
 
@@ -613,13 +619,19 @@ func (m *controlPlaneEndpointManager) doHealthCheck(ctx context.Context, node *v
 		}
 
 		if err != nil || resp.StatusCode != http.StatusOK {
+			controlPlaneHealthChecks.WithLabelValues("failure").Inc()
 			if err != nil {
 				klog.Errorf("http client error during healthcheck, will try to reassign to a healthy node. err \"%s\"", err)
 			}
 
 			klog.Info("doHealthCheck(): health check through elastic ip failed, trying to reassign to an available controlplane node")
-			return m.tryReassign(ctx, controlPlaneEndpoint, filterDeletingNodes, tryFilterUnschedulableNodes)
+			if err := m.tryReassign(ctx, controlPlaneEndpoint, filterDeletingNodes, tryFilterUnschedulableNodes); err != nil {
+				m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonControlPlaneEIPReassignFailed, "Control plane endpoint %s failed its health check through node and could not be reassigned: %s", controlPlaneEndpoint.GetAddress(), err)
+				return err
+			}
+			return nil
 		}
+		controlPlaneHealthChecks.WithLabelValues("success").Inc()
 	}
 
 	return nil
@@ -0,0 +1,284 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-provider-equinix-metal/metal/loadbalancers"
+)
+
+/*
+eipGarbageCollector releases the EIPs of services that were deleted while the CCM was not running,
+and so never had EnsureLoadBalancerDeleted called for them. Every interval, it lists the reservations
+tagged for the cluster, and those whose service tags match none of the existing services of
+type=LoadBalancer are orphaned. An orphaned reservation is deleted, or released if it was adopted,
+once it has been orphaned for gracePeriod, so that a service that is being created or deleted is not
+raced, and its address is removed from the load balancer implementation. A reservation shared with
+services that still exist is kept, and only the tags of the services that no longer do are removed.
+IP reservation blocks are left to ipam, which instead has the addresses allocated to services that
+no longer exist released.
+
+With dryRun, orphaned reservations and addresses are only reported in the logs.
+*/
+type eipGarbageCollector struct {
+	client      *metal.APIClient
+	k8sclient   kubernetes.Interface
+	project     string
+	clusterID   string
+	ipam        *ipam
+	implementor loadbalancers.LB
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+	// orphaned is when each orphaned reservation, by ID, or allocation, by service name, or tag of a
+	// shared reservation, by reservation ID and tag, was first found
+	orphaned map[string]time.Time
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func newEIPGarbageCollector(client *metal.APIClient, k8sclient kubernetes.Interface, clusterID string, ipam *ipam, implementor loadbalancers.LB, metalConfig Config) (*eipGarbageCollector, error) {
+	interval, err := parseDuration(metalConfig.EIPGCInterval, DefaultEIPGCInterval)
+	if err != nil {
+		return nil, err
+	}
+	gracePeriod, err := parseDuration(metalConfig.EIPGCGracePeriod, DefaultEIPGCGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	return &eipGarbageCollector{
+		client:      client,
+		k8sclient:   k8sclient,
+		project:     metalConfig.ProjectID,
+		clusterID:   clusterID,
+		ipam:        ipam,
+		implementor: implementor,
+		interval:    interval,
+		gracePeriod: gracePeriod,
+		dryRun:      metalConfig.EIPGCDryRun,
+		orphaned:    map[string]time.Time{},
+		now:         time.Now,
+	}, nil
+}
+
+// run collects orphaned EIPs every interval until stop is closed
+func (g *eipGarbageCollector) run(stop <-chan struct{}) {
+	if g.interval <= 0 {
+		klog.V(2).Info("eipGarbageCollector.run(): garbage collection disabled")
+		return
+	}
+	klog.Infof("collecting orphaned EIPs every %s, after a grace period of %s, dry run %t", g.interval, g.gracePeriod, g.dryRun)
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := g.collect(context.Background()); err != nil {
+				klog.Errorf("failed to collect orphaned EIPs for project %s: %v", g.project, err)
+			}
+		}
+	}
+}
+
+// collect releases the reservations and allocations that have been orphaned for gracePeriod
+func (g *eipGarbageCollector) collect(ctx context.Context) error {
+	// services are listed before reservations, so that a reservation requested for a new service
+	// in between is orphaned at most until the next run
+	services, err := g.k8sclient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list services: %w", err)
+	}
+	owners := map[string]bool{}
+	for i := range services.Items {
+		svc := &services.Items[i]
+		if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		owners[serviceTag(svc)] = true
+		owners[serviceRep(svc)] = true
+	}
+
+	ips, err := listIPReservations(ctx, g.client, g.project)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve IP reservations for project %s: %w", g.project, err)
+	}
+
+	now := g.now()
+	orphaned := map[string]time.Time{}
+	for _, ipReservation := range ipReservationsByAllTags([]string{emTag, clusterTag(g.clusterID)}, ips) {
+		if !ipReservationOrphaned(ipReservation, owners) {
+			g.collectServiceTags(ctx, ipReservation, owners, now, orphaned)
+			continue
+		}
+		id := ipReservation.GetId()
+		if !g.expired(id, now, orphaned) {
+			continue
+		}
+		if g.dryRun {
+			klog.Infof("dry run: would collect orphaned IP reservation %s %s", id, ipReservation.GetAddress())
+			continue
+		}
+		if err := g.releaseIPReservation(ctx, ipReservation); err != nil {
+			klog.Errorf("failed to collect orphaned IP reservation %s: %v", id, err)
+		}
+	}
+
+	if g.ipam != nil {
+		names, err := g.ipam.services(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if owners[name] || !g.expired(name, now, orphaned) {
+				continue
+			}
+			if g.dryRun {
+				klog.Infof("dry run: would collect orphaned IP allocation of service %s", name)
+				continue
+			}
+			if err := g.releaseAllocation(ctx, name); err != nil {
+				klog.Errorf("failed to collect orphaned IP allocation of service %s: %v", name, err)
+			}
+		}
+	}
+
+	g.orphaned = orphaned
+	return nil
+}
+
+// expired records that the reservation or allocation with the key is orphaned, and returns true if it
+// has been for gracePeriod. Only the keys found orphaned in a run are kept for the next one.
+func (g *eipGarbageCollector) expired(key string, now time.Time, orphaned map[string]time.Time) bool {
+	since, ok := g.orphaned[key]
+	if !ok {
+		since = now
+	}
+	orphaned[key] = since
+	if now.Sub(since) < g.gracePeriod {
+		klog.V(2).Infof("%s is orphaned since %s, within grace period", key, since.Format(time.RFC3339))
+		return false
+	}
+	return true
+}
+
+// collectServiceTags removes the tags of the services that no longer exist from a reservation that is
+// not orphaned, as it is shared with services that still do, once they have been orphaned for gracePeriod.
+// Its address stays in the load balancer implementation, for the other services.
+func (g *eipGarbageCollector) collectServiceTags(ctx context.Context, ipReservation *metal.IPReservation, owners map[string]bool, now time.Time, orphaned map[string]time.Time) {
+	if slices.Contains(ipReservation.GetTags(), ipamBlockTag) {
+		return
+	}
+	id := ipReservation.GetId()
+	var remove []string
+	for _, tag := range ipReservationServiceTags(ipReservation) {
+		if !owners[tag] && g.expired(id+"/"+tag, now, orphaned) {
+			remove = append(remove, tag)
+		}
+	}
+	if len(remove) == 0 {
+		return
+	}
+	if g.dryRun {
+		klog.Infof("dry run: would remove tags %v of services that no longer exist from IP reservation %s %s", remove, id, ipReservation.GetAddress())
+		return
+	}
+	// never nil, so that the tags are cleared if there are no others
+	tags := []string{}
+	for _, tag := range ipReservation.GetTags() {
+		if !slices.Contains(remove, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if _, _, err := g.client.IPAddressesApi.UpdateIPAddress(ctx, id).IPAssignmentUpdateInput(metal.IPAssignmentUpdateInput{Tags: tags}).Execute(); err != nil {
+		klog.Errorf("failed to remove tags of services that no longer exist from IP reservation %s: %v", id, err)
+		return
+	}
+	ipReservation.Tags = tags
+	klog.Infof("removed tags %v of services that no longer exist from shared IP reservation %s %s", remove, id, ipReservation.GetAddress())
+}
+
+// releaseIPReservation deletes an orphaned reservation, or releases it if it was adopted, and removes its
+// address from the load balancer implementation. The services it was for are only known by their tags,
+// so it is removed by address, which for MetalLB removes its address pool.
+func (g *eipGarbageCollector) releaseIPReservation(ctx context.Context, ipReservation *metal.IPReservation) error {
+	id := ipReservation.GetId()
+	if slices.Contains(ipReservation.GetTags(), adoptedTag) {
+		if err := releaseIPReservation(ctx, g.client.IPAddressesApi, ipReservation); err != nil {
+			return err
+		}
+		eipReservationsReleased.WithLabelValues("released").Inc()
+		klog.Infof("released orphaned adopted IP reservation %s %s", id, ipReservation.GetAddress())
+	} else {
+		if _, err := g.client.IPAddressesApi.DeleteIPAddress(ctx, id).Execute(); err != nil {
+			return fmt.Errorf("failed to remove IP address reservation %s from project: %w", ipReservation.GetAddress(), err)
+		}
+		eipReservationsReleased.WithLabelValues("deleted").Inc()
+		klog.Infof("deleted orphaned IP reservation %s %s", id, ipReservation.GetAddress())
+	}
+	svcIPCidr := fmt.Sprintf("%s/%d", ipReservation.GetAddress(), ipReservation.GetCidr())
+	return g.removeFromImplementor(ctx, &v1.Service{}, svcIPCidr)
+}
+
+// releaseAllocation releases the address allocated to a service that no longer exists
+func (g *eipGarbageCollector) releaseAllocation(ctx context.Context, name string) error {
+	namespace, svcName, _ := strings.Cut(name, "/")
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: svcName}}
+	addr, err := g.ipam.release(ctx, svc)
+	if err != nil {
+		return err
+	}
+	klog.Infof("released orphaned IP %s of service %s", addr, name)
+	if addr == "" {
+		return nil
+	}
+	return g.removeFromImplementor(ctx, svc, fmt.Sprintf("%s/%d", addr, hostPrefixLength(v1.IPv4Protocol)))
+}
+
+// removeFromImplementor removes the address of a service that no longer exists from the load balancer implementation
+func (g *eipGarbageCollector) removeFromImplementor(ctx context.Context, svc *v1.Service, svcIPCidr string) error {
+	if g.implementor == nil {
+		return nil
+	}
+	if err := g.implementor.RemoveService(ctx, svc.Namespace, svc.Name, []string{svcIPCidr}, svc); err != nil {
+		return fmt.Errorf("failed to remove %s from the load balancer implementation: %w", svcIPCidr, err)
+	}
+	return nil
+}
+
+// ipReservationOrphaned returns true if a reservation was requested or adopted for services,
+// and none of them is among the owners. IP reservation blocks are never orphaned.
+func ipReservationOrphaned(ipReservation *metal.IPReservation, owners map[string]bool) bool {
+	tags := ipReservation.GetTags()
+	if slices.Contains(tags, ipamBlockTag) {
+		return false
+	}
+	svcTags := ipReservationServiceTags(ipReservation)
+	for _, tag := range svcTags {
+		if owners[tag] {
+			return false
+		}
+	}
+	return len(svcTags) > 0
+}
+
+// ipReservationServiceTags returns the tags of the services a reservation was requested or adopted for
+func ipReservationServiceTags(ipReservation *metal.IPReservation) []string {
+	var svcTags []string
+	for _, tag := range ipReservation.GetTags() {
+		if strings.HasPrefix(tag, serviceTagPrefix) {
+			svcTags = append(svcTags, tag)
+		}
+	}
+	return svcTags
+}
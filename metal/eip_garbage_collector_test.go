@@ -0,0 +1,134 @@
+package metal
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	"sigs.k8s.io/cloud-provider-equinix-metal/metal/loadbalancers/empty"
+)
+
+func TestIPReservationOrphaned(t *testing.T) {
+	owners := map[string]bool{"service=a": true}
+	tests := []struct {
+		tags     []string
+		orphaned bool
+	}{
+		{[]string{emTag, "service=a"}, false},
+		{[]string{emTag, "service=b"}, true},
+		{[]string{emTag, "service=a", "service=b"}, false},
+		{[]string{emTag, "service=b", adoptedTag}, true},
+		{[]string{emTag, "service=b", ipamBlockTag}, false},
+		{[]string{emTag, ipamBlockTag}, false},
+		{[]string{emTag}, false},
+	}
+
+	for i, tt := range tests {
+		if orphaned := ipReservationOrphaned(&metal.IPReservation{Tags: tt.tags}, owners); orphaned != tt.orphaned {
+			t.Errorf("%d: mismatched orphaned for tags %v, actual %t expected %t", i, tt.tags, orphaned, tt.orphaned)
+		}
+	}
+}
+
+// testRemovingLB records the addresses removed from the load balancer implementation
+type testRemovingLB struct {
+	*empty.LB
+	removed []string
+}
+
+func (l *testRemovingLB) RemoveService(ctx context.Context, svcNamespace, svcName string, ips []string, svc *v1.Service) error {
+	l.removed = append(l.removed, ips...)
+	return nil
+}
+
+func TestEIPGarbageCollector(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+	}{
+		{"collect", false},
+		{"dry run", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc, server := testGetValidCloud(t, "")
+			ctx := context.Background()
+			owner := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "owner"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+			}
+			deleted := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deleted"}}
+			clsTag := clusterTag("cluster1")
+			owned := &metal.IPReservation{Id: metal.PtrString("owned"), Tags: []string{emTag, serviceTag(owner), clsTag}}
+			orphan := &metal.IPReservation{Id: metal.PtrString("orphan"), Tags: []string{emTag, serviceTag(deleted), clsTag}}
+			orphan.Address, orphan.Cidr = metal.PtrString("147.75.100.1"), metal.PtrInt32(32)
+			adopted := &metal.IPReservation{Id: metal.PtrString("adopted"), Tags: []string{"customer", emTag, serviceTag(deleted), clsTag, adoptedTag}}
+			adopted.Address, adopted.Cidr = metal.PtrString("147.75.100.2"), metal.PtrInt32(32)
+			otherCluster := &metal.IPReservation{Id: metal.PtrString("other"), Tags: []string{emTag, serviceTag(deleted), clusterTag("cluster2")}}
+			shared := &metal.IPReservation{Id: metal.PtrString("shared"), Tags: []string{emTag, serviceTag(owner), serviceTag(deleted), clsTag}}
+			server.IPReservationStore[vc.config.ProjectID] = &metal.IPReservationList{
+				IpAddresses: []metal.IPReservationListIpAddressesInner{
+					{IPReservation: owned}, {IPReservation: orphan}, {IPReservation: adopted}, {IPReservation: otherCluster}, {IPReservation: shared},
+				},
+			}
+
+			now := time.Now()
+			k8sclient := k8sfake.NewSimpleClientset(owner)
+			implementor := &testRemovingLB{LB: empty.NewLB(k8sclient, "")}
+			g, err := newEIPGarbageCollector(vc.client, k8sclient, "cluster1", nil, implementor,
+				Config{ProjectID: vc.config.ProjectID, EIPGCGracePeriod: "1h", EIPGCDryRun: tt.dryRun})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			g.now = func() time.Time { return now }
+
+			// nothing is collected within the grace period
+			if err := g.collect(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if remaining := server.IPReservationStore[vc.config.ProjectID].IpAddresses; len(remaining) != 5 {
+				t.Fatalf("collected within grace period, %d reservations left", len(remaining))
+			}
+
+			now = now.Add(time.Hour)
+			if err := g.collect(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var ids []string
+			for _, ip := range server.IPReservationStore[vc.config.ProjectID].IpAddresses {
+				ids = append(ids, ip.IPReservation.GetId())
+			}
+			expected := []string{"owned", "adopted", "other", "shared"}
+			if tt.dryRun {
+				expected = []string{"owned", "orphan", "adopted", "other", "shared"}
+			}
+			if !slices.Equal(ids, expected) {
+				t.Errorf("mismatched reservations, actual %v expected %v", ids, expected)
+			}
+			if released := !slices.Contains(adopted.Tags, adoptedTag); released == tt.dryRun {
+				t.Errorf("mismatched release of adopted reservation, tags %v", adopted.Tags)
+			}
+
+			// the addresses of the collected reservations are removed from the implementation
+			var removed []string
+			if !tt.dryRun {
+				removed = []string{"147.75.100.1/32", "147.75.100.2/32"}
+			}
+			if !slices.Equal(implementor.removed, removed) {
+				t.Errorf("mismatched removed addresses, actual %v expected %v", implementor.removed, removed)
+			}
+
+			// the shared reservation is kept, without the tag of the deleted service
+			if untagged := !slices.Contains(shared.Tags, serviceTag(deleted)); untagged == tt.dryRun || !slices.Contains(shared.Tags, serviceTag(owner)) {
+				t.Errorf("mismatched tags of shared reservation %v", shared.Tags)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package metal
+
+// reasons of the events that the provider records on services and nodes
+const (
+	eventReasonEIPRequested                  = "EIPRequested"
+	eventReasonEIPReleased                   = "EIPReleased"
+	eventReasonBGPSessionFailed              = "BGPSessionFailed"
+	eventReasonNodeAnnotationFailed          = "NodeAnnotationFailed"
+	eventReasonControlPlaneEIPReassigned     = "ControlPlaneEIPReassigned"
+	eventReasonControlPlaneEIPReassignFailed = "ControlPlaneEIPReassignFailed"
+)
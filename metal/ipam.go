@@ -0,0 +1,318 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// ipamConfigMapName is the name of the ConfigMap in kube-system in which the allocations are tracked
+	ipamConfigMapName      = "cloud-provider-equinix-metal-ipam"
+	ipamConfigMapNamespace = "kube-system"
+	// ipamBlockTag marks the blocks requested by ipam, along with emTag and the cluster tag
+	ipamBlockTag = "ipam=block"
+	// minEIPBlockSize and maxEIPBlockSize are the prefix lengths of the largest and smallest blocks to request
+	minEIPBlockSize = 24
+	maxEIPBlockSize = 30
+)
+
+/*
+ipam allocates the IPv4 EIPs of services from larger reservations, blocks, so that many services
+share a few reservations. It tracks the allocations in a ConfigMap, in which each key is an address,
+and its value the service it is allocated to.
+
+A block given by ID is used alone, and never released. Otherwise, blocks of blockSize are requested
+as needed, in the location of each service, tagged for the cluster, and released once none of their
+addresses are allocated.
+*/
+type ipam struct {
+	client    *metal.APIClient
+	k8sclient kubernetes.Interface
+	project   string
+	clusterID string
+	blockSize int
+	blockID   string
+	// lock serializes allocations, as each reads and then updates the ConfigMap
+	lock sync.Mutex
+}
+
+func newIPAM(client *metal.APIClient, k8sclient kubernetes.Interface, project, clusterID string, blockSize int, blockID string) *ipam {
+	return &ipam{
+		client:    client,
+		k8sclient: k8sclient,
+		project:   project,
+		clusterID: clusterID,
+		blockSize: blockSize,
+		blockID:   blockID,
+	}
+}
+
+// allocated returns the address allocated to the service, or an empty string if it has none
+func (m *ipam) allocated(ctx context.Context, svc *v1.Service) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cm, _, err := m.allocations(ctx)
+	if err != nil {
+		return "", err
+	}
+	return allocatedAddress(cm, serviceRep(svc)), nil
+}
+
+// services returns the names of the services that have an address allocated, as namespace/name
+func (m *ipam) services(ctx context.Context) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cm, _, err := m.allocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, name := range cm.Data {
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
+
+// allocate returns the address allocated to the service, allocating a free one if it has none.
+// Blocks in the metro, or if that is empty the facility, are searched for a free address,
+// and a new block is requested if all of them are full.
+func (m *ipam) allocate(ctx context.Context, svc *v1.Service, metro, facility string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	svcName := serviceRep(svc)
+	cm, found, err := m.allocations(ctx)
+	if err != nil {
+		return "", err
+	}
+	if addr := allocatedAddress(cm, svcName); addr != "" {
+		return addr, nil
+	}
+
+	blocks, err := m.blocks(ctx)
+	if err != nil {
+		return "", err
+	}
+	var addr string
+	for _, block := range blocks {
+		// a given block is used wherever it is
+		if m.blockID == "" && !ipReservationInLocation(block, metro, facility) {
+			continue
+		}
+		if addr = freeAddress(block, cm.Data); addr != "" {
+			break
+		}
+	}
+
+	if addr == "" {
+		if m.blockID != "" {
+			return "", fmt.Errorf("no free address in IP reservation block %s for service %s", m.blockID, svcName)
+		}
+		block, err := m.requestBlock(ctx, metro, facility)
+		if err != nil {
+			return "", err
+		}
+		if addr = freeAddress(block, cm.Data); addr == "" {
+			return "", fmt.Errorf("no free address in new IP reservation block %s for service %s", block.GetId(), svcName)
+		}
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[addr] = svcName
+	if err := m.saveAllocations(ctx, cm, found); err != nil {
+		return "", fmt.Errorf("failed to save allocation of %s to service %s: %w", addr, svcName, err)
+	}
+	klog.Infof("allocated IP %s to service %s", addr, svcName)
+	return addr, nil
+}
+
+// release frees the address allocated to the service, and returns it, or an empty string if it had none.
+// A block that was requested by ipam is released too, once none of its addresses are allocated.
+func (m *ipam) release(ctx context.Context, svc *v1.Service) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	svcName := serviceRep(svc)
+	cm, _, err := m.allocations(ctx)
+	if err != nil {
+		return "", err
+	}
+	addr := allocatedAddress(cm, svcName)
+	if addr == "" {
+		return "", nil
+	}
+	delete(cm.Data, addr)
+	if err := m.saveAllocations(ctx, cm, true); err != nil {
+		return "", fmt.Errorf("failed to save release of %s from service %s: %w", addr, svcName, err)
+	}
+	klog.Infof("released IP %s from service %s", addr, svcName)
+
+	ip, err := netip.ParseAddr(addr)
+	if m.blockID != "" || err != nil {
+		return addr, nil
+	}
+	blocks, err := m.blocks(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, block := range blocks {
+		prefix, err := ipReservationPrefix(block)
+		if err != nil || !prefix.Contains(ip) {
+			continue
+		}
+		if blockInUse(prefix, cm.Data) {
+			break
+		}
+		klog.Infof("releasing IP reservation block %s %s, no longer in use", block.GetId(), prefix)
+		if _, err := m.client.IPAddressesApi.DeleteIPAddress(ctx, block.GetId()).Execute(); err != nil {
+			return "", fmt.Errorf("failed to release IP reservation block %s: %w", block.GetId(), err)
+		}
+		eipReservationsReleased.WithLabelValues("deleted").Inc()
+		break
+	}
+	return addr, nil
+}
+
+// blocks returns the block given by ID, or the blocks requested for the cluster
+func (m *ipam) blocks(ctx context.Context) ([]*metal.IPReservation, error) {
+	ips, err := listIPReservations(ctx, m.client, m.project)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve IP reservations for project %s: %w", m.project, err)
+	}
+	if m.blockID == "" {
+		return ipReservationsByAllTags([]string{emTag, clusterTag(m.clusterID), ipamBlockTag}, ips), nil
+	}
+	for _, ip := range ips.GetIpAddresses() {
+		if ip.IPReservation != nil && ip.IPReservation.GetId() == m.blockID {
+			return []*metal.IPReservation{ip.IPReservation}, nil
+		}
+	}
+	return nil, fmt.Errorf("IP reservation block %s not found in project %s", m.blockID, m.project)
+}
+
+// requestBlock requests a new block of blockSize in the metro, or if that is empty the facility
+func (m *ipam) requestBlock(ctx context.Context, metro, facility string) (*metal.IPReservation, error) {
+	input := metal.IPReservationRequestInput{
+		Type:                   "public_ipv4",
+		Quantity:               int32(1) << (32 - m.blockSize),
+		Details:                ptr.To(ccmIPDescription),
+		Tags:                   []string{emTag, clusterTag(m.clusterID), ipamBlockTag},
+		FailOnApprovalRequired: ptr.To(true),
+	}
+	if metro != "" {
+		input.Metro = &metro
+	} else {
+		input.Facility = &facility
+	}
+	resp, _, err := m.client.IPAddressesApi.
+		RequestIPReservation(ctx, m.project).
+		RequestIPReservationRequest(metal.RequestIPReservationRequest{IPReservationRequestInput: &input}).
+		Execute()
+	if err != nil || resp == nil || resp.IPReservation == nil {
+		return nil, fmt.Errorf("failed to request a /%d IP reservation block: %w", m.blockSize, err)
+	}
+	eipReservationsRequested.Inc()
+	klog.Infof("requested IP reservation block %s %s/%d", resp.IPReservation.GetId(), resp.IPReservation.GetAddress(), resp.IPReservation.GetCidr())
+	return resp.IPReservation, nil
+}
+
+// allocations returns the ConfigMap of allocations, and whether it exists; a new one is not created until it is saved
+func (m *ipam) allocations(ctx context.Context) (*v1.ConfigMap, bool, error) {
+	cm, err := m.k8sclient.CoreV1().ConfigMaps(ipamConfigMapNamespace).Get(ctx, ipamConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ipamConfigMapNamespace, Name: ipamConfigMapName},
+		}, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to get IP allocations from ConfigMap %s/%s: %w", ipamConfigMapNamespace, ipamConfigMapName, err)
+	}
+	return cm, true, nil
+}
+
+// saveAllocations creates or updates the ConfigMap of allocations. A concurrent
+// change fails with a conflict, so that the service is retried on the latest allocations.
+func (m *ipam) saveAllocations(ctx context.Context, cm *v1.ConfigMap, found bool) error {
+	var err error
+	if !found {
+		_, err = m.k8sclient.CoreV1().ConfigMaps(ipamConfigMapNamespace).Create(ctx, cm, metav1.CreateOptions{})
+	} else {
+		_, err = m.k8sclient.CoreV1().ConfigMaps(ipamConfigMapNamespace).Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// allocatedAddress returns the address allocated to the service in the ConfigMap, or an empty string
+func allocatedAddress(cm *v1.ConfigMap, svcName string) string {
+	for addr, name := range cm.Data {
+		if name == svcName {
+			return addr
+		}
+	}
+	return ""
+}
+
+// freeAddress returns the first address of the block that is not allocated, or an empty string if it is full
+func freeAddress(block *metal.IPReservation, allocations map[string]string) string {
+	prefix, err := ipReservationPrefix(block)
+	if err != nil {
+		klog.Errorf("skipping IP reservation block %s: %v", block.GetId(), err)
+		return ""
+	}
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		if _, ok := allocations[addr.String()]; !ok {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// blockInUse returns true if any address of the block is allocated
+func blockInUse(prefix netip.Prefix, allocations map[string]string) bool {
+	for addr := range allocations {
+		if ip, err := netip.ParseAddr(addr); err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipReservationPrefix returns the network of a reservation
+func ipReservationPrefix(block *metal.IPReservation) (netip.Prefix, error) {
+	network := block.GetNetwork()
+	if network == "" {
+		network = block.GetAddress()
+	}
+	addr, err := netip.ParseAddr(network)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %q: %w", network, err)
+	}
+	prefix, err := addr.Prefix(int(block.GetCidr()))
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %s/%d: %w", network, block.GetCidr(), err)
+	}
+	return prefix, nil
+}
+
+// ipReservationInLocation returns true if the reservation is in the metro, or if that is empty the facility
+func ipReservationInLocation(ip *metal.IPReservation, metro, facility string) bool {
+	if metro != "" {
+		return strings.EqualFold(ip.Metro.GetCode(), metro)
+	}
+	return strings.EqualFold(ip.Facility.GetCode(), facility)
+}
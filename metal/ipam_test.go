@@ -0,0 +1,95 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func testIPAMService(name string) *v1.Service {
+	return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+}
+
+func TestIPAMRequestedBlock(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	ctx := context.Background()
+	m := newIPAM(vc.client, k8sfake.NewSimpleClientset(), vc.config.ProjectID, "cluster", maxEIPBlockSize, "")
+	svcA, svcB := testIPAMService("a"), testIPAMService("b")
+
+	addrA, err := m.allocate(ctx, svcA, "ny", "")
+	if err != nil {
+		t.Fatalf("unexpected error allocating to a: %v", err)
+	}
+	addrB, err := m.allocate(ctx, svcB, "ny", "")
+	if err != nil {
+		t.Fatalf("unexpected error allocating to b: %v", err)
+	}
+	if addrA == addrB {
+		t.Errorf("same address %s allocated to both services", addrA)
+	}
+	if blocks := server.IPReservationStore[vc.config.ProjectID].GetIpAddresses(); len(blocks) != 1 {
+		t.Fatalf("mismatched blocks, actual %d expected 1", len(blocks))
+	}
+
+	// allocating again returns the same address
+	if addr, err := m.allocate(ctx, svcA, "ny", ""); err != nil || addr != addrA {
+		t.Errorf("mismatched allocation to a, actual %s (%v) expected %s", addr, err, addrA)
+	}
+	if addr, err := m.allocated(ctx, svcB); err != nil || addr != addrB {
+		t.Errorf("mismatched allocated to b, actual %s (%v) expected %s", addr, err, addrB)
+	}
+
+	// the block is kept until both addresses are released
+	if addr, err := m.release(ctx, svcA); err != nil || addr != addrA {
+		t.Errorf("mismatched release of a, actual %s (%v) expected %s", addr, err, addrA)
+	}
+	if blocks := server.IPReservationStore[vc.config.ProjectID].GetIpAddresses(); len(blocks) != 1 {
+		t.Errorf("block released while still in use")
+	}
+	if _, err := m.release(ctx, svcB); err != nil {
+		t.Errorf("unexpected error releasing b: %v", err)
+	}
+	if blocks := server.IPReservationStore[vc.config.ProjectID].GetIpAddresses(); len(blocks) != 0 {
+		t.Errorf("mismatched blocks after release, actual %d expected 0", len(blocks))
+	}
+}
+
+func TestIPAMGivenBlock(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	ctx := context.Background()
+	block := &metal.IPReservation{
+		Id:      metal.PtrString("block"),
+		Network: metal.PtrString("147.75.100.0"),
+		Cidr:    metal.PtrInt32(31),
+		Metro:   &metal.IPReservationMetro{Code: metal.PtrString("da")},
+	}
+	server.IPReservationStore[vc.config.ProjectID] = &metal.IPReservationList{
+		IpAddresses: []metal.IPReservationListIpAddressesInner{{IPReservation: block}},
+	}
+	m := newIPAM(vc.client, k8sfake.NewSimpleClientset(), vc.config.ProjectID, "cluster", 0, "block")
+
+	// the given block is used wherever the service is
+	for _, name := range []string{"a", "b"} {
+		if _, err := m.allocate(ctx, testIPAMService(name), "ny", ""); err != nil {
+			t.Fatalf("unexpected error allocating to %s: %v", name, err)
+		}
+	}
+	if _, err := m.allocate(ctx, testIPAMService("c"), "ny", ""); err == nil {
+		t.Errorf("expected error allocating from a full block")
+	}
+
+	// the given block is never released
+	if _, err := m.release(ctx, testIPAMService("a")); err != nil {
+		t.Errorf("unexpected error releasing a: %v", err)
+	}
+	if _, err := m.release(ctx, testIPAMService("b")); err != nil {
+		t.Errorf("unexpected error releasing b: %v", err)
+	}
+	if blocks := server.IPReservationStore[vc.config.ProjectID].GetIpAddresses(); len(blocks) != 1 {
+		t.Errorf("given block was released")
+	}
+}
@@ -1,9 +1,46 @@
 package metal
 
 import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+
 	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
 )
 
+// maxIPReservationsPerPage is the largest number of IP reservations the API returns at once
+const maxIPReservationsPerPage = 1000
+
+// listIPReservations returns all of the IP reservations in a project, walking all of their pages.
+// FindIPReservations takes no page number, so the pages after the first are reached through their links.
+func listIPReservations(ctx context.Context, client *metal.APIClient, projectID string, include ...string) (*metal.IPReservationList, error) {
+	req := client.IPAddressesApi.FindIPReservations(ctx, projectID).PerPage(maxIPReservationsPerPage)
+	if len(include) > 0 {
+		req = req.Include(include)
+	}
+	page, _, err := req.Execute()
+	if err != nil {
+		return nil, err
+	}
+	ips := &metal.IPReservationList{IpAddresses: page.GetIpAddresses()}
+	path := fmt.Sprintf("/projects/%s/ips", url.PathEscape(projectID))
+	seen := map[string]bool{}
+	for next := nextPage(page.Meta); next != ""; next = nextPage(page.Meta) {
+		if seen[next] {
+			return nil, fmt.Errorf("unable to list IP reservations of project %s: page %s was already listed", projectID, next)
+		}
+		seen[next] = true
+		page = &metal.IPReservationList{}
+		if err := getNextPage(ctx, client, path, next, page); err != nil {
+			return nil, fmt.Errorf("unable to list IP reservations of project %s: %w", projectID, err)
+		}
+		ips.IpAddresses = append(ips.IpAddresses, page.GetIpAddresses()...)
+	}
+	return ips, nil
+}
+
 // ipReservationByAllTags given a set of metal.IPReservation and a set of tags, find
 // the first reservation that has all of those tags
 func ipReservationByAllTags(targetTags []string, ips *metal.IPReservationList) *metal.IPReservation {
@@ -14,6 +51,24 @@ func ipReservationByAllTags(targetTags []string, ips *metal.IPReservationList) *
 	return nil
 }
 
+// ipReservationByFamily returns the first of the reservations of the IP family, or nil if there is none
+func ipReservationByFamily(ips []*metal.IPReservation, family v1.IPFamily) *metal.IPReservation {
+	for _, ip := range ips {
+		if ipReservationFamily(ip) == family {
+			return ip
+		}
+	}
+	return nil
+}
+
+// ipReservationFamily returns the IP family of a reservation, from its address
+func ipReservationFamily(ip *metal.IPReservation) v1.IPFamily {
+	if addr, err := netip.ParseAddr(ip.GetAddress()); err == nil && addr.Is6() {
+		return v1.IPv6Protocol
+	}
+	return v1.IPv4Protocol
+}
+
 // ipReservationsByAllTags given a set of metal.IPReservation and a set of tags, find
 // all of the reservations that have all of those tags
 func ipReservationsByAllTags(targetTags []string, ips *metal.IPReservationList) []*metal.IPReservation {
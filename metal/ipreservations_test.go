@@ -1,9 +1,12 @@
 package metal
 
 import (
+	"context"
+	"fmt"
 	"testing"
 
 	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
 )
 
 func TestIPReservationByAllTags(t *testing.T) {
@@ -43,3 +46,61 @@ func TestIPReservationByAllTags(t *testing.T) {
 		}
 	}
 }
+
+func TestIPReservationByFamily(t *testing.T) {
+	ipv4 := &metal.IPReservation{Address: metal.PtrString("147.75.100.1")}
+	ipv6 := &metal.IPReservation{Address: metal.PtrString("2604:1380:4641:c500::10")}
+	tests := []struct {
+		ips      []*metal.IPReservation
+		family   v1.IPFamily
+		expected *metal.IPReservation
+	}{
+		{[]*metal.IPReservation{ipv4, ipv6}, v1.IPv4Protocol, ipv4},
+		{[]*metal.IPReservation{ipv4, ipv6}, v1.IPv6Protocol, ipv6},
+		{[]*metal.IPReservation{ipv6, ipv4}, v1.IPv4Protocol, ipv4},
+		{[]*metal.IPReservation{ipv4}, v1.IPv6Protocol, nil},
+		{nil, v1.IPv4Protocol, nil},
+	}
+
+	for i, tt := range tests {
+		if matched := ipReservationByFamily(tt.ips, tt.family); matched != tt.expected {
+			t.Errorf("%d: mismatched reservation for %s, actual %v expected %v", i, tt.family, matched, tt.expected)
+		}
+	}
+}
+
+func TestListIPReservations(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	var reservations []metal.IPReservationListIpAddressesInner
+	for i := range 5 {
+		reservations = append(reservations, metal.IPReservationListIpAddressesInner{IPReservation: &metal.IPReservation{Id: metal.PtrString(fmt.Sprintf("ip-%d", i))}})
+	}
+	server.IPReservationStore[vc.config.ProjectID] = &metal.IPReservationList{IpAddresses: reservations}
+	tests := []struct {
+		name     string
+		pageSize int
+	}{
+		{"not paged", 0},
+		{"single page", 5},
+		{"full pages", 1},
+		{"partial last page", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.PageSize = tt.pageSize
+			ips, err := listIPReservations(context.Background(), vc.client, vc.config.ProjectID)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(ips.GetIpAddresses()) != len(reservations) {
+				t.Fatalf("mismatched reservations, actual %d expected %d", len(ips.GetIpAddresses()), len(reservations))
+			}
+			for i, ip := range ips.GetIpAddresses() {
+				if expected := fmt.Sprintf("ip-%d", i); ip.IPReservation.GetId() != expected {
+					t.Errorf("%d: mismatched reservation, actual %s expected %s", i, ip.IPReservation.GetId(), expected)
+				}
+			}
+		})
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/netip"
 	"net/url"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -23,47 +25,96 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	k8stypes "k8s.io/apimachinery/pkg/types"
+	v1applyconfig "k8s.io/client-go/applyconfigurations/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/ptr"
 )
 
+const (
+	// eipAssignmentSpec saves the EIP of a service to its deprecated Spec.LoadBalancerIP
+	eipAssignmentSpec = "spec"
+	// eipAssignmentAnnotation records the EIP of a service in an annotation owned by the CCM, leaving its spec alone
+	eipAssignmentAnnotation = "annotation"
+)
+
 type loadBalancers struct {
-	client                *metal.APIClient
-	k8sclient             kubernetes.Interface
-	project               string
-	metro                 string
-	facility              string
-	clusterID             string
-	implementor           loadbalancers.LB
-	implementorConfig     string
-	localASN              int
-	bgpPass               string
-	annotationNetwork     string
-	annotationLocalASN    string
-	annotationPeerASN     string
-	annotationPeerIP      string
-	annotationSrcIP       string
-	annotationBgpPass     string
-	eipMetroAnnotation    string
-	eipFacilityAnnotation string
-	nodeSelector          labels.Selector
-	eipTag                string
-	usesBGP               bool
-}
-
-func newLoadBalancers(client *metal.APIClient, k8sclient kubernetes.Interface, authToken, projectID, metro, facility, config string, localASN int, bgpPass, annotationNetwork, annotationLocalASN, annotationPeerASN, annotationPeerIP, annotationSrcIP, annotationBgpPass, eipMetroAnnotation, eipFacilityAnnotation, nodeSelector, eipTag string) (*loadBalancers, error) {
+	client                      *metal.APIClient
+	devices                     *deviceCache
+	k8sclient                   kubernetes.Interface
+	recorder                    record.EventRecorder
+	project                     string
+	metro                       string
+	facility                    string
+	clusterID                   string
+	implementor                 loadbalancers.LB
+	implementorConfig           string
+	localASN                    int
+	bgpPass                     string
+	annotationNetwork           string
+	annotationLocalASN          string
+	annotationPeerASN           string
+	annotationPeerIP            string
+	annotationSrcIP             string
+	annotationBgpPass           string
+	eipMetroAnnotation          string
+	eipFacilityAnnotation       string
+	eipGlobalAnnotation         string
+	eipReservationIDAnnotation  string
+	eipReservationTagAnnotation string
+	eipSharingKeyAnnotation     string
+	eipAssignedAnnotation       string
+	nodeSelector                labels.Selector
+	eipTag                      string
+	eipAssignment               string
+	usesBGP                     bool
+	// ipam allocates EIPs from shared blocks, if enabled
+	ipam *ipam
+}
+
+// newLoadBalancers returns the load balancers configured by metalConfig. The local ASN and BGP password
+// are those of the project, as set up by bgp.
+func newLoadBalancers(client *metal.APIClient, devices *deviceCache, k8sclient kubernetes.Interface, recorder record.EventRecorder, localASN int, bgpPass string, metalConfig Config) (*loadBalancers, error) {
 	selector := labels.Everything()
-	if nodeSelector != "" {
-		selector, _ = labels.Parse(nodeSelector)
+	if metalConfig.BGPNodeSelector != "" {
+		selector, _ = labels.Parse(metalConfig.BGPNodeSelector)
 	}
 
 	// TODO: refactor this and related functions so we can move common code
 	// for BGP-based load balancers somewhere else
 	defaultUsesBgp := true
 
-	l := &loadBalancers{client, k8sclient, projectID, metro, facility, "", nil, config, localASN, bgpPass, annotationNetwork, annotationLocalASN, annotationPeerASN, annotationPeerIP, annotationSrcIP, annotationBgpPass, eipMetroAnnotation, eipFacilityAnnotation, selector, eipTag, defaultUsesBgp}
+	l := &loadBalancers{
+		client:                      client,
+		devices:                     devices,
+		k8sclient:                   k8sclient,
+		recorder:                    recorder,
+		project:                     metalConfig.ProjectID,
+		metro:                       metalConfig.Metro,
+		facility:                    metalConfig.Facility,
+		implementorConfig:           metalConfig.LoadBalancerSetting,
+		localASN:                    localASN,
+		bgpPass:                     bgpPass,
+		annotationNetwork:           metalConfig.AnnotationNetworkIPv4Private,
+		annotationLocalASN:          metalConfig.AnnotationLocalASN,
+		annotationPeerASN:           metalConfig.AnnotationPeerASN,
+		annotationPeerIP:            metalConfig.AnnotationPeerIP,
+		annotationSrcIP:             metalConfig.AnnotationSrcIP,
+		annotationBgpPass:           metalConfig.AnnotationBGPPass,
+		eipMetroAnnotation:          metalConfig.AnnotationEIPMetro,
+		eipFacilityAnnotation:       metalConfig.AnnotationEIPFacility,
+		eipGlobalAnnotation:         metalConfig.AnnotationEIPGlobal,
+		eipReservationIDAnnotation:  metalConfig.AnnotationEIPReservationID,
+		eipReservationTagAnnotation: metalConfig.AnnotationEIPReservationTag,
+		eipSharingKeyAnnotation:     metalConfig.AnnotationEIPSharingKey,
+		eipAssignedAnnotation:       metalConfig.AnnotationEIPAssigned,
+		nodeSelector:                selector,
+		eipTag:                      metalConfig.EIPTag,
+		eipAssignment:               metalConfig.EIPAssignment,
+		usesBGP:                     defaultUsesBgp,
+	}
 
 	// parse the implementor config and see what kind it is - allow for no config
 	if l.implementorConfig == "" {
@@ -100,7 +151,10 @@ func newLoadBalancers(client *metal.APIClient, k8sclient kubernetes.Interface, a
 		impl = empty.NewLB(k8sclient, lbconfig)
 	case "emlb":
 		klog.Info("loadbalancer implementation enabled: emlb")
-		impl = emlb.NewLB(k8sclient, lbconfig, authToken, projectID)
+		impl, err = emlb.NewLB(k8sclient, recorder, lbconfig, lbflags, metalConfig.AuthToken, metalConfig.ProjectID, metalConfig.LBaaSBaseURL, metalConfig.TokenExchangeURL, client.GetConfig().HTTPClient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid emlb config: %w", err)
+		}
 		// TODO remove when common BGP code has been refactored to somewhere else
 		l.usesBGP = false
 	default:
@@ -110,6 +164,10 @@ func newLoadBalancers(client *metal.APIClient, k8sclient kubernetes.Interface, a
 
 	l.clusterID = string(systemNamespace.UID)
 	l.implementor = impl
+	if metalConfig.EIPBlockSize != 0 || metalConfig.EIPBlockID != "" {
+		klog.Info("loadbalancer EIPs are allocated from shared blocks")
+		l.ipam = newIPAM(client, k8sclient, metalConfig.ProjectID, l.clusterID, metalConfig.EIPBlockSize, metalConfig.EIPBlockID)
+	}
 	klog.V(2).Info("loadBalancers.init(): complete")
 	return l, nil
 }
@@ -125,29 +183,42 @@ func (l *loadBalancers) GetLoadBalancer(ctx context.Context, clusterName string,
 	svcName := serviceRep(service)
 	svcTag := serviceTag(service)
 	clsTag := clusterTag(l.clusterID)
-	svcIP := service.Spec.LoadBalancerIP
+	svcIP := l.serviceIP(service)
 
 	if l.usesBGP {
 		// get IP address reservations and check if they any exists for this svc
-		ips, _, err := l.client.IPAddressesApi.
-			FindIPReservations(context.Background(), l.project).
-			Execute()
+		ips, err := listIPReservations(context.Background(), l.client, l.project)
 		if err != nil {
 			return nil, false, fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
 		}
 
-		ipReservation := ipReservationByAllTags([]string{svcTag, emTag, clsTag}, ips)
+		ipReservations := ipReservationsByAllTags([]string{svcTag, emTag, clsTag}, ips)
 
 		klog.V(2).Infof("GetLoadBalancer(): remove: %s with existing IP assignment %s", svcName, svcIP)
 
-		// get the IPs and see if there is anything to clean up
-		if ipReservation == nil {
+		// one ingress per IP family of the service, primary family first
+		var ingress []v1.LoadBalancerIngress
+		for _, family := range serviceIPFamilies(service) {
+			if ipReservation := ipReservationByFamily(ipReservations, family); ipReservation != nil {
+				ingress = append(ingress, v1.LoadBalancerIngress{IP: ipReservation.GetAddress()})
+				continue
+			}
+			if l.ipam == nil || family != v1.IPv4Protocol {
+				continue
+			}
+			addr, err := l.ipam.allocated(ctx, service)
+			if err != nil {
+				return nil, false, err
+			}
+			if addr != "" {
+				ingress = append(ingress, v1.LoadBalancerIngress{IP: addr})
+			}
+		}
+		if len(ingress) == 0 {
 			return nil, false, nil
 		}
 		return &v1.LoadBalancerStatus{
-			Ingress: []v1.LoadBalancerIngress{
-				{IP: ipReservation.GetAddress()},
-			},
+			Ingress: ingress,
 		}, true, nil
 	} else {
 		return l.implementor.GetLoadBalancer(ctx, clusterName, service)
@@ -213,38 +284,11 @@ func (l *loadBalancers) UpdateLoadBalancer(ctx context.Context, clusterName stri
 
 	// TODO remove this conditional when common BGP code has been refactored to somewhere else
 	if l.usesBGP {
-		for _, node := range filterNodes(nodes, l.nodeSelector) {
-			klog.V(2).Infof("UpdateLoadBalancer(): %s", node.Name)
-			// get the node provider ID
-			id := node.Spec.ProviderID
-			if id == "" {
-				return fmt.Errorf("no provider ID given for node %s, skipping", node.Name)
-			}
-			// ensure BGP is enabled for the node
-			if err := ensureNodeBGPEnabled(id, l.client); err != nil {
-				klog.Errorf("could not ensure BGP enabled for node %s: %s", node.Name, err)
-				continue
-			}
-			klog.V(2).Infof("bgp enabled on node %s", node.Name)
-			// ensure the node has the correct annotations
-			if err := l.annotateNode(ctx, node); err != nil {
-				return fmt.Errorf("failed to annotate node %s: %w", node.Name, err)
-			}
-			var (
-				peer *metal.BgpNeighborData
-				err  error
-			)
-			if peer, err = getNodeBGPConfig(id, l.client); err != nil || peer == nil {
-				return fmt.Errorf("could not add metallb node peer address for node %s: %w", node.Name, err)
-			}
-			n = append(n, loadbalancers.Node{
-				Name:     node.Name,
-				LocalASN: int(peer.GetCustomerAs()),
-				PeerASN:  int(peer.GetPeerAs()),
-				SourceIP: peer.GetCustomerIp(),
-				Peers:    peer.GetPeerIps(),
-				Password: peer.GetMd5Password(),
-			})
+		// only the families the service has an EIP of are peered, as addService may have
+		// served a service that prefers dual-stack with its primary family only
+		bgpNodes := filterNodes(nodes, l.nodeSelector)
+		for _, family := range serviceEIPFamilies(service) {
+			n = append(n, l.nodePeers(ctx, bgpNodes, family)...)
 		}
 	}
 
@@ -264,39 +308,72 @@ func (l *loadBalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterNa
 	svcName := serviceRep(service)
 	svcTag := serviceTag(service)
 	clsTag := clusterTag(l.clusterID)
-	svcIP := service.Spec.LoadBalancerIP
+	svcIP := l.serviceIP(service)
 
-	var svcIPCidr string
+	var svcIPCidrs []string
 
 	if l.usesBGP {
 		// get IP address reservations and check if they any exists for this svc
-		ips, _, err := l.client.IPAddressesApi.
-			FindIPReservations(context.Background(), l.project).
-			Execute()
+		ips, err := listIPReservations(context.Background(), l.client, l.project)
 		if err != nil {
 			return fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
 		}
 
-		ipReservation := ipReservationByAllTags([]string{svcTag, emTag, clsTag}, ips)
+		// a dual-stack service has one reservation per IP family
+		ipReservations := ipReservationsByAllTags([]string{svcTag, emTag, clsTag}, ips)
 
 		klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: %s with existing IP assignment %s", svcName, svcIP)
 
+		// an IP allocated from a shared block is released to it
+		if l.ipam != nil {
+			addr, err := l.ipam.release(ctx, service)
+			if err != nil {
+				return fmt.Errorf("failed to release IP of %s: %w", svcName, err)
+			}
+			if addr != "" {
+				svcIPCidrs = append(svcIPCidrs, fmt.Sprintf("%s/%d", addr, hostPrefixLength(v1.IPv4Protocol)))
+			}
+		}
+
 		// get the IPs and see if there is anything to clean up
-		if ipReservation == nil {
+		if len(ipReservations) == 0 && len(svcIPCidrs) == 0 {
 			klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: no IP reservation found for %s, nothing to delete", svcName)
 			return nil
 		}
-		// delete the reservation
-		klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: for %s EIP ID %s", svcName, ipReservation.GetId())
-		if _, err := l.client.IPAddressesApi.DeleteIPAddress(context.Background(), ipReservation.GetId()).Execute(); err != nil {
-			return fmt.Errorf("failed to remove IP address reservation %s from project: %w", ipReservation.GetAddress(), err)
+		for _, ipReservation := range ipReservations {
+			if ipReservationSharedWithOthers(ipReservation, svcTag) {
+				// the reservation is kept for the other services that share it, and so is its IP in the implementation
+				klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: for %s unsharing EIP ID %s, still in use", svcName, ipReservation.GetId())
+				if err := l.unshareIPReservation(ctx, service, ipReservation); err != nil {
+					return err
+				}
+				continue
+			}
+			if slices.Contains(ipReservation.GetTags(), adoptedTag) {
+				// the reservation existed before the service, so only release it
+				klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: for %s releasing adopted EIP ID %s", svcName, ipReservation.GetId())
+				if err := releaseIPReservation(ctx, l.client.IPAddressesApi, ipReservation); err != nil {
+					return err
+				}
+				eipReservationsReleased.WithLabelValues("released").Inc()
+				l.recorder.Eventf(service, v1.EventTypeNormal, eventReasonEIPReleased, "Released adopted EIP %s", ipReservation.GetAddress())
+			} else {
+				// delete the reservation
+				klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: for %s EIP ID %s", svcName, ipReservation.GetId())
+				if _, err := l.client.IPAddressesApi.DeleteIPAddress(context.Background(), ipReservation.GetId()).Execute(); err != nil {
+					return fmt.Errorf("failed to remove IP address reservation %s from project: %w", ipReservation.GetAddress(), err)
+				}
+				eipReservationsReleased.WithLabelValues("deleted").Inc()
+				l.recorder.Eventf(service, v1.EventTypeNormal, eventReasonEIPReleased, "Deleted EIP %s", ipReservation.GetAddress())
+			}
+			// remove it from any implementation-specific parts
+			svcIPCidr := fmt.Sprintf("%s/%d", ipReservation.GetAddress(), ipReservation.GetCidr())
+			klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: for %s entry %s", svcName, svcIPCidr)
+			svcIPCidrs = append(svcIPCidrs, svcIPCidr)
 		}
-		// remove it from any implementation-specific parts
-		svcIPCidr = fmt.Sprintf("%s/%d", ipReservation.GetAddress(), ipReservation.GetCidr())
-		klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: for %s entry %s", svcName, svcIPCidr)
 	}
 
-	if err := l.implementor.RemoveService(ctx, service.Namespace, service.Name, svcIPCidr, service); err != nil {
+	if err := l.implementor.RemoveService(ctx, service.Namespace, service.Name, svcIPCidrs, service); err != nil {
 		return fmt.Errorf("error removing IP from configmap for %s: %w", svcName, err)
 	}
 	klog.V(2).Infof("EnsureLoadBalancerDeleted(): remove: removed service %s from implementation", svcName)
@@ -328,14 +405,14 @@ func (l *loadBalancers) annotateNode(ctx context.Context, node *v1.Node) error {
 	}
 
 	// get the network info
-	network, err := getNodePrivateNetwork(id, l.client)
+	network, err := getNodePrivateNetwork(id, l.devices)
 	if err != nil || network == "" {
 		return fmt.Errorf("could not get private network info for node %s: %w", node.Name, err)
 	}
 	annotations[l.annotationNetwork] = network
 
 	// get the bgp info
-	peer, err := getNodeBGPConfig(id, l.client)
+	peer, err := getNodeBGPConfig(id, l.client, v1.IPv4Protocol)
 	switch {
 	case err != nil || peer == nil:
 		return fmt.Errorf("could not get BGP info for node %s: %w", node.Name, err)
@@ -394,165 +471,435 @@ func (l *loadBalancers) annotateNode(ctx context.Context, node *v1.Node) error {
 }
 
 // addService add a single service; wraps the implementation
-func (l *loadBalancers) addService(ctx context.Context, svc *v1.Service, nodes []*v1.Node, loadBalancerName string) (string, error) {
+func (l *loadBalancers) addService(ctx context.Context, svc *v1.Service, nodes []*v1.Node, loadBalancerName string) ([]string, error) {
 	svcName := serviceRep(svc)
-	svcTag := serviceTag(svc)
-	svcRegion := serviceAnnotation(svc, l.eipMetroAnnotation)
-	svcZone := serviceAnnotation(svc, l.eipFacilityAnnotation)
-	clsTag := clusterTag(l.clusterID)
-	svcIP := svc.Spec.LoadBalancerIP
 
 	var (
-		svcIPCidr string
-		err       error
-		n         []loadbalancers.Node
-		ips       *metal.IPReservationList
+		svcIPCidrs []string
+		n          []loadbalancers.Node
 	)
 
 	if l.usesBGP {
 		// get IP address reservations and check if they any exists for this svc
-		ips, _, err = l.client.IPAddressesApi.FindIPReservations(context.Background(), l.project).Execute()
+		ips, err := listIPReservations(context.Background(), l.client, l.project)
 		if err != nil {
-			return "", fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
-		}
-		ipReservation := ipReservationByAllTags([]string{svcTag, emTag, clsTag}, ips)
-
-		klog.V(2).Infof("processing %s with existing IP assignment %s", svcName, svcIP)
-		// if it already has an IP, no need to get it one
-		if svcIP == "" {
-			klog.V(2).Infof("no IP assigned for service %s; searching reservations", svcName)
-
-			// if no IP found, request a new one
-			if ipReservation == nil {
-
-				// if we did not find an IP reserved, create a request
-				klog.V(2).Infof("no IP assignment found for %s, requesting", svcName)
-				// create a request
-				// our logic as to where to create the IP:
-				// 1. if metro is set globally, use it; else
-				// 2. if facility is set globally, use it; else
-				// 3. if Service.Metadata.Labels["topology.kubernetes.io/region"] is set, use it; else
-				// 4. if Service.Metadata.Labels["topology.kubernetes.io/zone"] is set, use it; else
-				// 5. Return error, cannot set an EIP
-				facility := l.facility
-				metro := l.metro
-				input := &metal.IPReservationRequestInput{
-					Type:     "public_ipv4",
-					Quantity: 1,
-					Details:  ptr.To(ccmIPDescription),
-					Tags: []string{
-						emTag,
-						svcTag,
-						clsTag,
-					},
-					FailOnApprovalRequired: ptr.To(true),
+			return nil, fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+		}
+
+		families := serviceIPFamilies(svc)
+		for i, family := range families {
+			svcIPCidr, err := l.ensureServiceIP(ctx, svc, family, i == 0, ips)
+			// a dual-stack service that only prefers dual-stack still is served by its primary family
+			if err != nil && i > 0 && isPreferDualStack(svc) {
+				klog.Errorf("failed to get %s IP for service %s, continuing with %s only: %v", family, svcName, families[0], err)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			// if we have no IP from existing or a new reservation, wait until it is allocated
+			if svcIPCidr == "" {
+				return nil, nil
+			}
+			svcIPCidrs = append(svcIPCidrs, svcIPCidr)
+			n = append(n, l.nodePeers(ctx, nodes, family)...)
+		}
+	}
+
+	return svcIPCidrs, l.implementor.AddService(ctx, svc.Namespace, svc.Name, svcIPCidrs, n, svc, nodes, loadBalancerName)
+}
+
+// ensureServiceIP finds or requests the EIP of the IP family for a service, and returns it in CIDR notation.
+// The EIP of the primary family is saved to the service, as it has room for only one.
+// It returns an empty string if the reservation has been requested, but no IP is allocated yet.
+func (l *loadBalancers) ensureServiceIP(ctx context.Context, svc *v1.Service, family v1.IPFamily, primary bool, ips *metal.IPReservationList) (string, error) {
+	svcName := serviceRep(svc)
+	svcTag := serviceTag(svc)
+	clsTag := clusterTag(l.clusterID)
+	shareTag := sharingKeyTag(svc, l.eipSharingKeyAnnotation)
+	var svcIP string
+	if primary {
+		svcIP = l.serviceIP(svc)
+	}
+	global, err := serviceGlobalIP(svc, l.eipGlobalAnnotation)
+	if err != nil {
+		return "", err
+	}
+	if global && family != v1.IPv4Protocol {
+		return "", fmt.Errorf("global IPs are IPv4 only, cannot get a global %s IP for service %s", family, svcName)
+	}
+
+	// a service bound to existing reservations uses those, else the reservations tagged for it
+	bound, err := l.boundIPReservations(svc, ips)
+	if err != nil {
+		return "", err
+	}
+	ipReservation := ipReservationByFamily(bound, family)
+	switch {
+	case ipReservation != nil:
+		if err := l.adoptIPReservation(ctx, svc, ipReservation); err != nil {
+			return "", err
+		}
+		// the bound reservation replaces any other IP saved to the service
+		if svcIP != ipReservation.GetAddress() {
+			svcIP = ""
+		}
+	case bound != nil && primary:
+		return "", fmt.Errorf("no %s IP reservation bound to service %s", family, svcName)
+	default:
+		ipReservation = ipReservationByFamily(ipReservationsByAllTags([]string{svcTag, emTag, clsTag}, ips), family)
+		// a service with a sharing key joins the reservation of the key, if another service requested it
+		if ipReservation == nil && shareTag != "" {
+			ipReservation = ipReservationByFamily(ipReservationsByAllTags([]string{shareTag, emTag, clsTag}, ips), family)
+			if ipReservation != nil {
+				if err := l.shareIPReservation(ctx, svc, ipReservation); err != nil {
+					return "", err
+				}
+				if svcIP != ipReservation.GetAddress() {
+					svcIP = ""
 				}
-				req := &metal.RequestIPReservationRequest{
-					IPReservationRequestInput: input,
+			}
+		}
+		// without a reservation of its own, the IPv4 EIP of a service is allocated from a shared block,
+		// except for services with a sharing key, which share a reservation instead
+		if ipReservation == nil && l.ipam != nil && family == v1.IPv4Protocol && !global && shareTag == "" {
+			return l.ensureBlockIP(ctx, svc, svcIP, primary)
+		}
+	}
+
+	klog.V(2).Infof("processing %s with existing IP assignment %s", svcName, svcIP)
+	// if it already has an IP, no need to get it one
+	if svcIP == "" {
+		klog.V(2).Infof("no %s IP assigned for service %s; searching reservations", family, svcName)
+
+		// if no IP found, request a new one
+		if ipReservation == nil {
+
+			// if we did not find an IP reserved, create a request
+			klog.V(2).Infof("no %s IP assignment found for %s, requesting", family, svcName)
+			// create a request
+			input := &metal.IPReservationRequestInput{
+				Type:     ipReservationType(family, global),
+				Quantity: 1,
+				Details:  ptr.To(ccmIPDescription),
+				Tags: []string{
+					emTag,
+					svcTag,
+					clsTag,
+				},
+				FailOnApprovalRequired: ptr.To(true),
+			}
+			if shareTag != "" {
+				input.Tags = append(input.Tags, shareTag)
+			}
+			req := &metal.RequestIPReservationRequest{
+				IPReservationRequestInput: input,
+			}
+			// global IPs are announced from every metro, and so have no location
+			if global {
+				klog.V(2).Infof("requesting global IP for %s", svcName)
+			} else {
+				metro, facility, err := l.eipLocation(svc)
+				if err != nil {
+					return "", err
 				}
-				switch {
-				case svcRegion != "":
-					input.Metro = &svcRegion
-				case svcZone != "":
-					input.Facility = &svcZone
-				case metro != "":
+				if metro != "" {
 					input.Metro = &metro
-				case facility != "":
+				} else {
 					input.Facility = &facility
-				default:
-					return "", errors.New("unable to create load balancer when no IP, region or zone specified, either globally or on service")
 				}
-
-				resp, _, err := l.client.IPAddressesApi.
-					RequestIPReservation(context.Background(), l.project).
-					RequestIPReservationRequest(*req).
-					Execute()
-				if err != nil || resp == nil {
-					return "", fmt.Errorf("failed to request an IP for the load balancer: %w", err)
-				}
-
-				ipReservation = resp.IPReservation
 			}
 
-			// if we have no IP from existing or a new reservation, log it and return
-			if ipReservation == nil {
-				klog.V(2).Infof("no IP to assign to service %s, will need to wait until it is allocated", svcName)
-				return "", nil
+			resp, _, err := l.client.IPAddressesApi.
+				RequestIPReservation(context.Background(), l.project).
+				RequestIPReservationRequest(*req).
+				Execute()
+			if err != nil || resp == nil {
+				return "", fmt.Errorf("failed to request an %s IP for the load balancer: %w", family, err)
 			}
+			eipReservationsRequested.Inc()
+			l.recorder.Eventf(svc, v1.EventTypeNormal, eventReasonEIPRequested, "Requested %s EIP %s", family, resp.IPReservation.GetAddress())
 
-			// we have an IP, either found from existing reservations or a new reservation.
-			// map and assign it
-			svcIP = ipReservation.GetAddress()
-
-			// assign the IP and save it
-			klog.V(2).Infof("assigning IP %s to %s", svcIP, svcName)
-			intf := l.k8sclient.CoreV1().Services(svc.Namespace)
-			existing, err := intf.Get(ctx, svc.Name, metav1.GetOptions{})
-			if err != nil || existing == nil {
-				klog.V(2).Infof("failed to get latest for service %s: %v", svcName, err)
-				return "", fmt.Errorf("failed to get latest for service %s: %w", svcName, err)
-			}
-			existing.Spec.LoadBalancerIP = svcIP
+			ipReservation = resp.IPReservation
+		}
 
-			_, err = intf.Update(ctx, existing, metav1.UpdateOptions{})
-			if err != nil {
-				klog.V(2).Infof("failed to update service %s: %v", svcName, err)
-				return "", fmt.Errorf("failed to update service %s: %w", svcName, err)
+		// if we have no IP from existing or a new reservation, log it and return
+		if ipReservation == nil {
+			klog.V(2).Infof("no %s IP to assign to service %s, will need to wait until it is allocated", family, svcName)
+			return "", nil
+		}
+
+		// we have an IP, either found from existing reservations or a new reservation.
+		// map and assign it
+		svcIP = ipReservation.GetAddress()
+
+		// assign the IP and save it
+		if primary {
+			if err := l.saveServiceIP(ctx, svc, svcIP); err != nil {
+				return "", err
 			}
-			klog.V(2).Infof("successfully assigned %s update service %s", svcIP, svcName)
 		}
-		// our default CIDR for each address is 32
-		cidr := int32(32)
-		if ipReservation != nil {
-			cidr = ipReservation.GetCidr()
+	}
+	// our default CIDR for each address is a single address, /32 or /128
+	cidr := hostPrefixLength(family)
+	if ipReservation != nil {
+		cidr = ipReservation.GetCidr()
+	}
+	return fmt.Sprintf("%s/%d", svcIP, cidr), nil
+}
+
+// ensureBlockIP allocates the IPv4 EIP of a service from a shared block, and returns it in CIDR notation.
+// An IP set on the service that was not allocated to it was brought by the user, and is kept.
+func (l *loadBalancers) ensureBlockIP(ctx context.Context, svc *v1.Service, svcIP string, primary bool) (string, error) {
+	addr, err := l.ipam.allocated(ctx, svc)
+	if err != nil {
+		return "", err
+	}
+	if addr == "" && svcIP != "" {
+		return fmt.Sprintf("%s/%d", svcIP, hostPrefixLength(v1.IPv4Protocol)), nil
+	}
+	if addr == "" {
+		metro, facility, err := l.eipLocation(svc)
+		if err != nil {
+			return "", err
+		}
+		if addr, err = l.ipam.allocate(ctx, svc, metro, facility); err != nil {
+			return "", fmt.Errorf("failed to allocate an IP for the load balancer: %w", err)
+		}
+	}
+	if primary && svcIP != addr {
+		if err := l.saveServiceIP(ctx, svc, addr); err != nil {
+			return "", err
 		}
-		svcIPCidr = fmt.Sprintf("%s/%d", svcIP, cidr)
-		// now need to pass it the nodes
+	}
+	return fmt.Sprintf("%s/%d", addr, hostPrefixLength(v1.IPv4Protocol)), nil
+}
 
-		for _, node := range nodes {
-			// get the node provider ID
-			id := node.Spec.ProviderID
-			if id == "" {
-				klog.Errorf("no provider ID given for node %s, skipping", node.Name)
-				continue
-			}
-			// ensure BGP is enabled for the node
-			if err := ensureNodeBGPEnabled(id, l.client); err != nil {
-				klog.Errorf("could not ensure BGP enabled for node %s: %s", node.Name, err)
-				continue
+// eipLocation returns the metro, or else the facility, in which to reserve the EIP of a service:
+// 1. if the Service has the EIP metro annotation, use it; else
+// 2. if the Service has the EIP facility annotation, use it; else
+// 3. if metro is set globally, use it; else
+// 4. if facility is set globally, use it; else
+// 5. Return error, cannot set an EIP
+func (l *loadBalancers) eipLocation(svc *v1.Service) (metro, facility string, err error) {
+	svcRegion := serviceAnnotation(svc, l.eipMetroAnnotation)
+	svcZone := serviceAnnotation(svc, l.eipFacilityAnnotation)
+	switch {
+	case svcRegion != "":
+		return svcRegion, "", nil
+	case svcZone != "":
+		return "", svcZone, nil
+	case l.metro != "":
+		return l.metro, "", nil
+	case l.facility != "":
+		return "", l.facility, nil
+	default:
+		return "", "", errors.New("unable to create load balancer when no IP, region or zone specified, either globally or on service")
+	}
+}
+
+// serviceIP returns the IP of a service: the load balancer IP, set by the user or saved by the CCM,
+// or else the IP recorded in the annotation
+func (l *loadBalancers) serviceIP(svc *v1.Service) string {
+	if svc.Spec.LoadBalancerIP != "" || l.eipAssignment != eipAssignmentAnnotation {
+		return svc.Spec.LoadBalancerIP
+	}
+	return serviceAnnotation(svc, l.eipAssignedAnnotation)
+}
+
+// saveServiceIP sets the IP as the load balancer IP on the latest version of the service, or, with
+// annotation assignment, applies the annotation with the CCM as field manager, so that the service
+// is not updated otherwise, and the user remains the sole owner of its spec
+func (l *loadBalancers) saveServiceIP(ctx context.Context, svc *v1.Service, svcIP string) error {
+	svcName := serviceRep(svc)
+	klog.V(2).Infof("assigning IP %s to %s", svcIP, svcName)
+	intf := l.k8sclient.CoreV1().Services(svc.Namespace)
+	if l.eipAssignment == eipAssignmentAnnotation {
+		applyConfig := v1applyconfig.Service(svc.Name, svc.Namespace).
+			WithAnnotations(map[string]string{l.eipAssignedAnnotation: svcIP})
+		if _, err := intf.Apply(ctx, applyConfig, metav1.ApplyOptions{FieldManager: emIdentifier, Force: true}); err != nil {
+			klog.V(2).Infof("failed to apply annotation to service %s: %v", svcName, err)
+			return fmt.Errorf("failed to apply annotation to service %s: %w", svcName, err)
+		}
+		klog.V(2).Infof("successfully assigned %s annotate service %s", svcIP, svcName)
+		return nil
+	}
+	existing, err := intf.Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil || existing == nil {
+		klog.V(2).Infof("failed to get latest for service %s: %v", svcName, err)
+		return fmt.Errorf("failed to get latest for service %s: %w", svcName, err)
+	}
+	existing.Spec.LoadBalancerIP = svcIP
+
+	_, err = intf.Update(ctx, existing, metav1.UpdateOptions{})
+	if err != nil {
+		klog.V(2).Infof("failed to update service %s: %v", svcName, err)
+		return fmt.Errorf("failed to update service %s: %w", svcName, err)
+	}
+	klog.V(2).Infof("successfully assigned %s update service %s", svcIP, svcName)
+	return nil
+}
+
+// boundIPReservations returns the existing reservations to which the annotations of a service bind it,
+// by reservation ID or by tag, or nil if the service is not bound to existing reservations
+func (l *loadBalancers) boundIPReservations(svc *v1.Service, ips *metal.IPReservationList) ([]*metal.IPReservation, error) {
+	if id := serviceAnnotation(svc, l.eipReservationIDAnnotation); id != "" {
+		for _, ip := range ips.GetIpAddresses() {
+			if ip.IPReservation != nil && ip.IPReservation.GetId() == id {
+				return []*metal.IPReservation{ip.IPReservation}, nil
 			}
-			klog.V(2).Infof("bgp enabled on node %s", node.Name)
-			// ensure the node has the correct annotations
+		}
+		return nil, fmt.Errorf("IP reservation %s for service %s not found", id, serviceRep(svc))
+	}
+	if tag := serviceAnnotation(svc, l.eipReservationTagAnnotation); tag != "" {
+		ret := ipReservationsByAllTags([]string{tag}, ips)
+		if len(ret) == 0 {
+			return nil, fmt.Errorf("no IP reservation with tag %s for service %s found", tag, serviceRep(svc))
+		}
+		return ret, nil
+	}
+	return nil, nil
+}
+
+// adoptIPReservation adds the tags of the service to an existing reservation, so that it is found
+// like the reservations created for services, and marks it as adopted, so that it never is deleted.
+// A reservation already tagged for another service or cluster cannot be adopted, unless the other
+// services share it with the same sharing key.
+func (l *loadBalancers) adoptIPReservation(ctx context.Context, svc *v1.Service, ipReservation *metal.IPReservation) error {
+	svcTag := serviceTag(svc)
+	clsTag := clusterTag(l.clusterID)
+	shareTag := sharingKeyTag(svc, l.eipSharingKeyAnnotation)
+	tags := ipReservation.GetTags()
+	shared := shareTag != "" && slices.Contains(tags, shareTag)
+	for _, tag := range tags {
+		if (strings.HasPrefix(tag, serviceTagPrefix) && tag != svcTag && !shared) || (strings.HasPrefix(tag, clusterTagPrefix) && tag != clsTag) {
+			return fmt.Errorf("IP reservation %s is in use by another service or cluster, tag %s", ipReservation.GetId(), tag)
+		}
+	}
+
+	adds := []string{emTag, svcTag, clsTag, adoptedTag}
+	if shareTag != "" {
+		adds = append(adds, shareTag)
+	}
+	klog.V(2).Infof("adopting IP reservation %s for service %s", ipReservation.GetId(), serviceRep(svc))
+	if err := l.addIPReservationTags(ctx, ipReservation, adds); err != nil {
+		return fmt.Errorf("failed to adopt IP reservation %s for service %s: %w", ipReservation.GetId(), serviceRep(svc), err)
+	}
+	return nil
+}
+
+// shareIPReservation adds the tag of the service to a reservation requested for another service with the same
+// sharing key, so that the reservation is kept until all the services that share it are deleted
+func (l *loadBalancers) shareIPReservation(ctx context.Context, svc *v1.Service, ipReservation *metal.IPReservation) error {
+	klog.V(2).Infof("sharing IP reservation %s with service %s", ipReservation.GetId(), serviceRep(svc))
+	if err := l.addIPReservationTags(ctx, ipReservation, []string{serviceTag(svc)}); err != nil {
+		return fmt.Errorf("failed to share IP reservation %s with service %s: %w", ipReservation.GetId(), serviceRep(svc), err)
+	}
+	return nil
+}
+
+// unshareIPReservation removes the tag of the service from a reservation that other services still share
+func (l *loadBalancers) unshareIPReservation(ctx context.Context, svc *v1.Service, ipReservation *metal.IPReservation) error {
+	svcTag := serviceTag(svc)
+	// never nil, so that the tags are cleared if there are no others
+	tags := []string{}
+	for _, tag := range ipReservation.GetTags() {
+		if tag != svcTag {
+			tags = append(tags, tag)
+		}
+	}
+	if _, _, err := l.client.IPAddressesApi.UpdateIPAddress(ctx, ipReservation.GetId()).IPAssignmentUpdateInput(metal.IPAssignmentUpdateInput{Tags: tags}).Execute(); err != nil {
+		return fmt.Errorf("failed to unshare IP reservation %s from service %s: %w", ipReservation.GetId(), serviceRep(svc), err)
+	}
+	ipReservation.Tags = tags
+	return nil
+}
+
+// addIPReservationTags adds any of the tags that a reservation does not have yet
+func (l *loadBalancers) addIPReservationTags(ctx context.Context, ipReservation *metal.IPReservation, adds []string) error {
+	tags := ipReservation.GetTags()
+	var missing []string
+	for _, tag := range adds {
+		if !slices.Contains(tags, tag) {
+			missing = append(missing, tag)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	tags = append(slices.Clone(tags), missing...)
+	if _, _, err := l.client.IPAddressesApi.UpdateIPAddress(ctx, ipReservation.GetId()).IPAssignmentUpdateInput(metal.IPAssignmentUpdateInput{Tags: tags}).Execute(); err != nil {
+		return err
+	}
+	ipReservation.Tags = tags
+	return nil
+}
+
+// releaseIPReservation removes the tags that adoptIPReservation added from a reservation, keeping any others
+func releaseIPReservation(ctx context.Context, client *metal.IPAddressesApiService, ipReservation *metal.IPReservation) error {
+	// never nil, so that the tags are cleared if there are no others
+	tags := []string{}
+	for _, tag := range ipReservation.GetTags() {
+		if tag != emTag && tag != adoptedTag && !strings.HasPrefix(tag, serviceTagPrefix) && !strings.HasPrefix(tag, clusterTagPrefix) && !strings.HasPrefix(tag, sharingKeyTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	if _, _, err := client.UpdateIPAddress(ctx, ipReservation.GetId()).IPAssignmentUpdateInput(metal.IPAssignmentUpdateInput{Tags: tags}).Execute(); err != nil {
+		return fmt.Errorf("failed to release IP reservation %s: %w", ipReservation.GetId(), err)
+	}
+	return nil
+}
+
+// nodePeers ensures BGP is enabled for the IP family on the nodes, and returns their BGP peers of the family.
+// Nodes whose BGP information cannot be retrieved are skipped.
+func (l *loadBalancers) nodePeers(ctx context.Context, nodes []*v1.Node, family v1.IPFamily) []loadbalancers.Node {
+	var n []loadbalancers.Node
+	for _, node := range nodes {
+		// get the node provider ID
+		id := node.Spec.ProviderID
+		if id == "" {
+			klog.Errorf("no provider ID given for node %s, skipping", node.Name)
+			continue
+		}
+		// ensure BGP is enabled for the node
+		if err := ensureNodeBGPEnabled(id, l.client, family); err != nil {
+			klog.Errorf("could not ensure BGP enabled for node %s: %s", node.Name, err)
+			l.recorder.Eventf(node, v1.EventTypeWarning, eventReasonBGPSessionFailed, "Could not enable %s BGP session: %s", family, err)
+			continue
+		}
+		klog.V(2).Infof("bgp enabled on node %s", node.Name)
+		// ensure the node has the correct annotations, which describe its IPv4 session
+		if family == v1.IPv4Protocol {
 			if err := l.annotateNode(ctx, node); err != nil {
 				klog.Errorf("failed to annotate node %s: %s", node.Name, err)
+				l.recorder.Eventf(node, v1.EventTypeWarning, eventReasonNodeAnnotationFailed, "Could not annotate node with its BGP session: %s", err)
 				continue
 			}
-			peer, err := getNodeBGPConfig(id, l.client)
-			if err != nil || peer == nil {
-				klog.Errorf("loadbalancers.addService(): could not get node peer address for node %s: %s", node.Name, err)
-				continue
-			}
-			n = append(n, loadbalancers.Node{
-				Name:     node.Name,
-				LocalASN: int(peer.GetCustomerAs()),
-				PeerASN:  int(peer.GetPeerAs()),
-				SourceIP: peer.GetCustomerIp(),
-				Peers:    peer.GetPeerIps(),
-				Password: peer.GetMd5Password(),
-			})
 		}
+		peer, err := getNodeBGPConfig(id, l.client, family)
+		if err != nil || peer == nil {
+			klog.Errorf("nodePeers(): could not get node peer address for node %s: %s", node.Name, err)
+			continue
+		}
+		n = append(n, loadbalancers.Node{
+			Name:     node.Name,
+			LocalASN: int(peer.GetCustomerAs()),
+			PeerASN:  int(peer.GetPeerAs()),
+			SourceIP: peer.GetCustomerIp(),
+			Peers:    peer.GetPeerIps(),
+			Password: peer.GetMd5Password(),
+		})
 	}
-
-	return svcIPCidr, l.implementor.AddService(ctx, svc.Namespace, svc.Name, svcIPCidr, n, svc, nodes, loadBalancerName)
+	return n
 }
 
 func (l *loadBalancers) retrieveIPByTag(ctx context.Context, svc *v1.Service, tag string) (string, error) {
 	svcName := serviceRep(svc)
-	svcIP := svc.Spec.LoadBalancerIP
+	svcIP := l.serviceIP(svc)
 	cidr := 32
 
 	// get IP address reservations and check if they any exists for this svc
-	ips, _, err := l.client.IPAddressesApi.FindIPReservations(context.Background(), l.project).Execute()
+	ips, err := listIPReservations(ctx, l.client, l.project)
 	if err != nil {
 		return "", err
 	}
@@ -575,21 +922,9 @@ func (l *loadBalancers) retrieveIPByTag(ctx context.Context, svc *v1.Service, ta
 		svcIP = ipReservation.GetAddress()
 
 		// assign the IP and save it
-		klog.V(2).Infof("assigning IP %s to %s", svcIP, svcName)
-		intf := l.k8sclient.CoreV1().Services(svc.Namespace)
-		existing, err := intf.Get(ctx, svc.Name, metav1.GetOptions{})
-		if err != nil || existing == nil {
-			klog.V(2).Infof("failed to get latest for service %s: %v", svcName, err)
-			return "", fmt.Errorf("failed to get latest for service %s: %w", svcName, err)
+		if err := l.saveServiceIP(ctx, svc, svcIP); err != nil {
+			return "", err
 		}
-		existing.Spec.LoadBalancerIP = svcIP
-
-		_, err = intf.Update(ctx, existing, metav1.UpdateOptions{})
-		if err != nil {
-			klog.V(2).Infof("failed to update service %s: %v", svcName, err)
-			return "", fmt.Errorf("failed to update service %s: %w", svcName, err)
-		}
-		klog.V(2).Infof("successfully assigned %s update service %s", svcIP, svcName)
 	}
 	if ipReservation != nil {
 		cidr = int(ipReservation.GetCidr())
@@ -621,19 +956,120 @@ func serviceTag(svc *v1.Service) string {
 		return ""
 	}
 	hash := sha256.Sum256([]byte(serviceRep(svc)))
-	return fmt.Sprintf("service=%s", base64.StdEncoding.EncodeToString(hash[:]))
+	return serviceTagPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// sharingKeyTag returns the tag of the reservation shared by the services of the namespace
+// with the same sharing key annotation, or an empty string if the service has none
+func sharingKeyTag(svc *v1.Service, annotation string) string {
+	key := serviceAnnotation(svc, annotation)
+	if key == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", svc.Namespace, key)))
+	return sharingKeyTagPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// ipReservationSharedWithOthers returns true if the reservation is tagged for other services than the given tag
+func ipReservationSharedWithOthers(ipReservation *metal.IPReservation, svcTag string) bool {
+	return slices.ContainsFunc(ipReservation.GetTags(), func(tag string) bool {
+		return strings.HasPrefix(tag, serviceTagPrefix) && tag != svcTag
+	})
 }
 
 func clusterTag(clusterID string) string {
-	return fmt.Sprintf("cluster=%s", clusterID)
+	return clusterTagPrefix + clusterID
 }
 
-// getNodePrivateNetwork use the Equinix Metal API to get the CIDR of the private network given a providerID.
-func getNodePrivateNetwork(deviceID string, client *metal.APIClient) (string, error) {
-	device, _, err := client.DevicesApi.
-		FindDeviceById(context.Background(), deviceID).
-		Include([]string{"ip_addresses.parent_block,parent_block"}).
-		Execute()
+// serviceIPFamily returns the primary IP family of the service, IPv4 if none is set
+func serviceIPFamily(svc *v1.Service) v1.IPFamily {
+	if len(svc.Spec.IPFamilies) > 0 {
+		return svc.Spec.IPFamilies[0]
+	}
+	return v1.IPv4Protocol
+}
+
+// serviceIPFamilies returns the IP families in which the service gets an EIP, the primary family first.
+// Services with a dual-stack IP family policy get both IPv4 and IPv6.
+func serviceIPFamilies(svc *v1.Service) []v1.IPFamily {
+	primary := serviceIPFamily(svc)
+	policy := svc.Spec.IPFamilyPolicy
+	if policy == nil || (*policy != v1.IPFamilyPolicyPreferDualStack && *policy != v1.IPFamilyPolicyRequireDualStack) {
+		return []v1.IPFamily{primary}
+	}
+	if primary == v1.IPv6Protocol {
+		return []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}
+	}
+	return []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+}
+
+// serviceEIPFamilies returns the IP families of a service that it has an EIP of, primary family first.
+// They are the families of the ingress IPs in its status, which are the EIPs GetLoadBalancer found.
+func serviceEIPFamilies(svc *v1.Service) []v1.IPFamily {
+	var families []v1.IPFamily
+	for _, family := range serviceIPFamilies(svc) {
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			addr, err := netip.ParseAddr(ingress.IP)
+			if err == nil && addr.Is6() == (family == v1.IPv6Protocol) {
+				families = append(families, family)
+				break
+			}
+		}
+	}
+	return families
+}
+
+// isPreferDualStack returns true if the service prefers, but does not require, dual-stack
+func isPreferDualStack(svc *v1.Service) bool {
+	return svc.Spec.IPFamilyPolicy != nil && *svc.Spec.IPFamilyPolicy == v1.IPFamilyPolicyPreferDualStack
+}
+
+// ipFamilyVersion returns the address family of an IP family as used by the Equinix Metal API, 4 or 6
+func ipFamilyVersion(family v1.IPFamily) int32 {
+	if family == v1.IPv6Protocol {
+		return 6
+	}
+	return 4
+}
+
+// ipReservationType returns the type of public IP reservation to request for an IP family.
+// IPv6 reservations are carved from the IPv6 allocation of the project in the metro.
+// Global reservations are anycast IPv4 addresses, announced from every metro.
+func ipReservationType(family v1.IPFamily, global bool) string {
+	switch {
+	case family == v1.IPv6Protocol:
+		return "public_ipv6"
+	case global:
+		return "global_ipv4"
+	default:
+		return "public_ipv4"
+	}
+}
+
+// serviceGlobalIP returns true if the service annotation requests a global IP
+func serviceGlobalIP(svc *v1.Service, annotation string) (bool, error) {
+	value := serviceAnnotation(svc, annotation)
+	if value == "" {
+		return false, nil
+	}
+	global, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("annotation %s of service %s must be a boolean, was %s: %w", annotation, serviceRep(svc), value, err)
+	}
+	return global, nil
+}
+
+// hostPrefixLength returns the prefix length of a single address of an IP family
+func hostPrefixLength(family v1.IPFamily) int32 {
+	if family == v1.IPv6Protocol {
+		return 128
+	}
+	return 32
+}
+
+// getNodePrivateNetwork use the device inventory to get the CIDR of the private network given a device ID.
+func getNodePrivateNetwork(deviceID string, devices *deviceCache) (string, error) {
+	device, err := devices.deviceByID(context.Background(), deviceID)
 	if err != nil {
 		return "", err
 	}
@@ -655,6 +1091,9 @@ func filterNodes(nodes []*v1.Node, nodeSelector labels.Selector) []*v1.Node {
 	filteredNodes := []*v1.Node{}
 
 	for _, node := range nodes {
+		if loadbalancers.IsTerminating(node) {
+			continue
+		}
 		if nodeSelector.Matches(labels.Set(node.Labels)) {
 			filteredNodes = append(filteredNodes, node)
 		}
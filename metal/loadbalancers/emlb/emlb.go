@@ -3,12 +3,18 @@ package emlb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
 	"sigs.k8s.io/cloud-provider-equinix-metal/metal/loadbalancers"
 	"sigs.k8s.io/cloud-provider-equinix-metal/metal/loadbalancers/emlb/infrastructure"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -18,30 +24,55 @@ import (
 type LB struct {
 	manager   *infrastructure.Manager
 	k8sclient kubernetes.Interface
+	recorder  record.EventRecorder
 	client    client.Client
 }
 
 const (
 	LoadBalancerIDAnnotation = "equinix.com/loadbalancerID"
+
+	// locationTimeout is how long the location of the load balancers is looked up at startup
+	locationTimeout = 30 * time.Second
+
+	// eventReasonOriginSyncFailed is the reason of the event recorded on a service whose load balancer could not be reconciled
+	eventReasonOriginSyncFailed = "LoadBalancerOriginSyncFailed"
 )
 
 var _ loadbalancers.LB = (*LB)(nil)
 
-func NewLB(k8sclient kubernetes.Interface, config, metalAPIKey, projectID string) *LB {
+func NewLB(k8sclient kubernetes.Interface, recorder record.EventRecorder, config string, flags url.Values, metalAPIKey, projectID, baseURL, tokenExchangeURL string, httpClient *http.Client) (*LB, error) {
 	// Parse config for Equinix Metal Load Balancer
 	// The format is emlb:///<location>
 	// An example config using Dallas as the location would look like emlb:///da
 	// it may have an extra slash at the beginning or end, so get rid of it
 	metro := strings.TrimPrefix(config, "/")
+	// The IDs of the location and provider are discovered from the API, unless given as in
+	// emlb:///da?locationID=<location ID>&providerID=<provider ID>
+	locationID := flags.Get("locationID")
+	providerID := flags.Get("providerID")
 
 	// Create a new LB object.
 	lb := &LB{}
 
-	// Set the manager subobject to have the API key and project id and metro.
-	lb.manager = infrastructure.NewManager(metalAPIKey, projectID, metro)
+	// Set the manager subobject to have the API key and project id and metro, the URLs of the
+	// APIs if not the defaults, and the HTTP client shared with the Equinix Metal API client.
+	lb.manager = infrastructure.NewManager(metalAPIKey, projectID, metro, locationID, providerID, baseURL, tokenExchangeURL, httpClient)
+
+	// Validate the metro now, rather than when the first load balancer is created. Other errors, such as
+	// a failed discovery, may be temporary, and the location is resolved again for the first load balancer.
+	ctx, cancel := context.WithTimeout(context.Background(), locationTimeout)
+	defer cancel()
+	if _, _, err := lb.manager.ResolveLocation(ctx); err != nil {
+		var unknown *infrastructure.UnknownMetroError
+		if errors.As(err, &unknown) {
+			return nil, err
+		}
+		klog.Warningf("unable to resolve the load balancer location of metro %s, retrying when a load balancer is created: %v", lb.manager.GetMetro(), err)
+	}
 
-	// Pass the k8sclient into the LB object.
+	// Pass the k8sclient and event recorder into the LB object.
 	lb.k8sclient = k8sclient
+	lb.recorder = recorder
 
 	// Set up a new controller-runtime k8s client for LB object.
 	scheme := runtime.NewScheme()
@@ -55,19 +86,23 @@ func NewLB(k8sclient kubernetes.Interface, config, metalAPIKey, projectID string
 	}
 	lb.client = newClient
 
-	return lb
+	registerMetrics()
+
+	return lb, nil
 }
 
-func (l *LB) AddService(ctx context.Context, svcNamespace, svcName, ip string, nodes []loadbalancers.Node, svc *v1.Service, n []*v1.Node, loadBalancerName string) error {
+func (l *LB) AddService(ctx context.Context, svcNamespace, svcName string, ips []string, nodes []loadbalancers.Node, svc *v1.Service, n []*v1.Node, loadBalancerName string) error {
 	return l.reconcileService(ctx, svc, n, loadBalancerName)
 }
 
-func (l *LB) RemoveService(ctx context.Context, svcNamespace, svcName, ip string, svc *v1.Service) error {
+func (l *LB) RemoveService(ctx context.Context, svcNamespace, svcName string, ips []string, svc *v1.Service) error {
 	// 1. Gather the properties we need: ID of load balancer
 	loadBalancerId := svc.Annotations[LoadBalancerIDAnnotation]
 
 	// 2. Delete the infrastructure (do we need to return anything here?)
+	start := time.Now()
 	err := l.manager.DeleteLoadBalancer(ctx, loadBalancerId)
+	observeReconcile("delete", start, err)
 
 	return err
 }
@@ -82,9 +117,12 @@ func (l *LB) reconcileService(ctx context.Context, svc *v1.Service, n []*v1.Node
 
 	pools := l.convertToPools(svc, n)
 
+	start := time.Now()
 	loadBalancer, err := l.manager.ReconcileLoadBalancer(ctx, loadBalancerId, loadBalancerName, pools)
+	observeReconcile("reconcile", start, err)
 
 	if err != nil {
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonOriginSyncFailed, "Could not sync the origins of the load balancer: %s", err)
 		return err
 	}
 
@@ -108,6 +146,9 @@ func (l *LB) convertToPools(svc *v1.Service, nodes []*v1.Node) infrastructure.Po
 	for _, svcPort := range svc.Spec.Ports {
 		targets := []infrastructure.Target{}
 		for _, node := range nodes {
+			if loadbalancers.IsTerminating(node) {
+				continue
+			}
 			for _, address := range node.Status.Addresses {
 				if address.Type == v1.NodeExternalIP {
 					targets = append(targets, infrastructure.Target{
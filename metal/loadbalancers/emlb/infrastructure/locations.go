@@ -0,0 +1,167 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"k8s.io/klog/v2"
+	lbaas "sigs.k8s.io/cloud-provider-equinix-metal/internal/lbaas/v1"
+)
+
+// defaultProviderID and defaultLocations are used when the provider and locations cannot be
+// discovered from the Load Balancer API, so that the metros known to support it keep working
+const defaultProviderID = "loadpvd-gOB_-byp5ebFo7A3LHv2B"
+
+var defaultLocations = map[string]string{
+	"da": "lctnloc--uxs0GLeAELHKV8GxO_AI",
+	"ny": "lctnloc-Vy-1Qpw31mPi6RJQwVf9A",
+	"sv": "lctnloc-H5rl2M2VL5dcFmdxhbEKx",
+}
+
+// metroCodePattern matches the codes of Equinix metros, such as sv
+var metroCodePattern = regexp.MustCompile(`^[a-z]{2}$`)
+
+// UnknownMetroError is returned when the metro of the load balancers is neither a discovered nor a default location
+type UnknownMetroError struct {
+	Metro  string
+	Metros []string
+}
+
+func (e *UnknownMetroError) Error() string {
+	return fmt.Sprintf("could not determine load balancer location for metro %q; valid values are %v", e.Metro, e.Metros)
+}
+
+// locationCollection and providerCollection are the responses of the Load Balancer API listing locations and providers
+type locationCollection struct {
+	Locations []lbaas.LoadBalancerLocation `json:"locations"`
+}
+
+type providerCollection struct {
+	Providers []lbaas.Provider `json:"providers"`
+}
+
+// ResolveLocation returns the IDs of the location of the metro and of the provider with which load balancers are
+// created. IDs that were not configured are discovered from the Load Balancer API, or if that fails or does not
+// find the metro taken from the defaults, and then cached. If the metro is in neither, the error of the discovery is
+// returned if it failed, else an UnknownMetroError.
+func (m *Manager) ResolveLocation(ctx context.Context) (locationID, providerID string, err error) {
+	m.locationLock.Lock()
+	defer m.locationLock.Unlock()
+
+	if m.locationID == "" {
+		metro := strings.ToLower(m.metro)
+		locations, err := m.discoverLocations(ctx)
+		if err != nil {
+			klog.Warningf("unable to discover load balancer locations, using the defaults: %v", err)
+		}
+		id, ok := locations[metro]
+		if !ok {
+			id, ok = defaultLocations[metro]
+			if ok && err == nil {
+				klog.Warningf("metro %s is not a discovered load balancer location, using the default", metro)
+			}
+		}
+		if !ok && err != nil {
+			return "", "", fmt.Errorf("unable to discover load balancer locations, and metro %q has no default location: %w", m.metro, err)
+		}
+		if !ok {
+			metros := slices.Collect(maps.Keys(defaultLocations))
+			for metro := range locations {
+				if !slices.Contains(metros, metro) {
+					metros = append(metros, metro)
+				}
+			}
+			slices.Sort(metros)
+			return "", "", &UnknownMetroError{Metro: m.metro, Metros: metros}
+		}
+		m.locationID = id
+	}
+
+	if m.providerID == "" {
+		id, err := m.discoverProvider(ctx)
+		if err != nil {
+			klog.Warningf("unable to discover load balancer provider, using the default: %v", err)
+			id = defaultProviderID
+		}
+		m.providerID = id
+	}
+
+	return m.locationID, m.providerID, nil
+}
+
+// discoverLocations returns the IDs of the locations of the Load Balancer API by their metro codes. The API has no
+// metro field, so only locations named by a metro code are returned, and those with other names are skipped.
+func (m *Manager) discoverLocations(ctx context.Context) (map[string]string, error) {
+	var collection locationCollection
+	if err := m.list(ctx, "/v1/locations", &collection); err != nil {
+		return nil, err
+	}
+	locations := map[string]string{}
+	for _, location := range collection.Locations {
+		metro := strings.ToLower(location.GetName())
+		if location.GetId() == "" || !metroCodePattern.MatchString(metro) {
+			klog.V(2).Infof("skipping load balancer location %q named %q, which is not a metro code", location.GetId(), location.GetName())
+			continue
+		}
+		locations[metro] = location.GetId()
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("no locations found")
+	}
+	return locations, nil
+}
+
+// discoverProvider returns the ID of the provider of the Load Balancer API, which must be the only one
+func (m *Manager) discoverProvider(ctx context.Context) (string, error) {
+	var collection providerCollection
+	if err := m.list(ctx, "/v1/providers", &collection); err != nil {
+		return "", err
+	}
+	if len(collection.Providers) != 1 || collection.Providers[0].GetId() == "" {
+		return "", fmt.Errorf("found %d providers, expected 1", len(collection.Providers))
+	}
+	return collection.Providers[0].GetId(), nil
+}
+
+// list gets a collection from the Load Balancer API, which the generated client has no operation for
+func (m *Manager) list(ctx context.Context, path string, collection any) error {
+	config := m.client.GetConfig()
+	baseURL, err := config.ServerURLWithContext(ctx, "")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	token, err := m.tokenSource.Token()
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(req)
+	req.Header.Set("Accept", "application/json")
+	if config.UserAgent != "" {
+		req.Header.Set("User-Agent", config.UserAgent)
+	}
+
+	resp, err := config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s failed with status %d, body %s", path, resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, collection)
+}
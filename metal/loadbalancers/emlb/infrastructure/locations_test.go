@@ -0,0 +1,93 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveLocation(t *testing.T) {
+	tests := []struct {
+		name                   string
+		metro                  string
+		locationID, providerID string
+		discovery              bool
+		expectedLocation       string
+		expectedProvider       string
+		requests               int
+		unknown                bool
+		failed                 bool
+	}{
+		{"discovered", "AM", "", "", true, "lctnloc-am", "loadpvd-discovered", 2, false, false},
+		{"configured", "am", "lctnloc-configured", "loadpvd-configured", true, "lctnloc-configured", "loadpvd-configured", 0, false, false},
+		{"defaults", "da", "", "", false, defaultLocations["da"], defaultProviderID, 2, false, false},
+		{"default of undiscovered metro", "da", "", "", true, defaultLocations["da"], "loadpvd-discovered", 2, false, false},
+		{"unknown discovered metro", "ch", "", "", true, "", "", 1, true, false},
+		{"location not named by metro code", "dallas", "", "", true, "", "", 1, true, false},
+		// the metro may be a location, so the discovery error is returned rather than an unknown metro
+		{"failed discovery without default", "am", "", "", false, "", "", 1, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			mux := http.NewServeMux()
+			mux.HandleFunc("/exchange", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+			})
+			mux.HandleFunc("/v1/locations", func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if !tt.discovery {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if r.Header.Get("Authorization") != "Bearer token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				_, _ = w.Write([]byte(`{"locations": [{"id": "lctnloc-am", "name": "am"}, {"id": "lctnloc-sg", "name": "sg"}, {"id": "lctnloc-dallas", "name": "Dallas"}]}`))
+			})
+			mux.HandleFunc("/v1/providers", func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if !tt.discovery {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				_, _ = w.Write([]byte(`{"providers": [{"id": "loadpvd-discovered", "name": "Equinix Metal"}]}`))
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			m := NewManager("key", "project", tt.metro, tt.locationID, tt.providerID, server.URL, server.URL+"/exchange", server.Client())
+			locationID, providerID, err := m.ResolveLocation(context.Background())
+			var unknown *UnknownMetroError
+			if errors.As(err, &unknown) != tt.unknown {
+				t.Fatalf("mismatched error, actual %v expected unknown metro %t", err, tt.unknown)
+			}
+			// the valid metros are both the discovered and the default ones
+			if tt.unknown && tt.discovery && !slices.Equal(unknown.Metros, []string{"am", "da", "ny", "sg", "sv"}) {
+				t.Errorf("mismatched valid metros %v", unknown.Metros)
+			}
+			if failed := err != nil && !tt.unknown; failed != tt.failed || (failed && !strings.Contains(err.Error(), "status 404")) {
+				t.Fatalf("mismatched error, actual %v expected discovery failure %t", err, tt.failed)
+			}
+			if locationID != tt.expectedLocation || providerID != tt.expectedProvider {
+				t.Errorf("mismatched IDs, actual %s %s expected %s %s", locationID, providerID, tt.expectedLocation, tt.expectedProvider)
+			}
+
+			// resolved IDs are cached
+			if !tt.unknown && !tt.failed {
+				if _, _, err := m.ResolveLocation(context.Background()); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if requests != tt.requests {
+				t.Errorf("mismatched requests, actual %d expected %d", requests, tt.requests)
+			}
+		})
+	}
+}
@@ -4,20 +4,15 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
-	"reflect"
+	"sync"
 
+	"golang.org/x/oauth2"
+	"k8s.io/klog/v2"
 	lbaas "sigs.k8s.io/cloud-provider-equinix-metal/internal/lbaas/v1"
 )
 
-const ProviderID = "loadpvd-gOB_-byp5ebFo7A3LHv2B"
-
-var LBMetros = map[string]string{
-	"da": "lctnloc--uxs0GLeAELHKV8GxO_AI",
-	"ny": "lctnloc-Vy-1Qpw31mPi6RJQwVf9A",
-	"sv": "lctnloc-H5rl2M2VL5dcFmdxhbEKx",
-}
-
 type Pools map[int32][]Target
 
 type Target struct {
@@ -26,24 +21,34 @@ type Target struct {
 }
 
 type Manager struct {
-	client         *lbaas.APIClient
-	metro          string
-	projectID      string
-	tokenExchanger *TokenExchanger
+	client      *lbaas.APIClient
+	metro       string
+	projectID   string
+	tokenSource oauth2.TokenSource
+	// locationID and providerID of new load balancers, configured or resolved by ResolveLocation
+	locationID   string
+	providerID   string
+	locationLock sync.Mutex
 }
 
-func NewManager(metalAPIKey, projectID, metro string) *Manager {
+func NewManager(metalAPIKey, projectID, metro, locationID, providerID, baseURL, tokenExchangeURL string, httpClient *http.Client) *Manager {
 	manager := &Manager{}
 	emlbConfig := lbaas.NewConfiguration()
 	emlbConfig.Debug = checkDebugEnabled()
+	emlbConfig.HTTPClient = httpClient
+	if baseURL != "" {
+		emlbConfig.Servers = lbaas.ServerConfigurations{{URL: baseURL}}
+	}
+	if tokenExchangeURL == "" {
+		tokenExchangeURL = DefaultTokenExchangeURL
+	}
 
 	manager.client = lbaas.NewAPIClient(emlbConfig)
-	manager.tokenExchanger = &TokenExchanger{
-		metalAPIKey: metalAPIKey,
-		client:      manager.client.GetConfig().HTTPClient,
-	}
+	manager.tokenSource = NewTokenSource(metalAPIKey, tokenExchangeURL, manager.client.GetConfig().HTTPClient)
 	manager.projectID = projectID
 	manager.metro = metro
+	manager.locationID = locationID
+	manager.providerID = providerID
 
 	return manager
 }
@@ -54,29 +59,92 @@ func (m *Manager) GetMetro() string {
 
 // Returns a Load Balancer object given an id
 func (m *Manager) GetLoadBalancer(ctx context.Context, id string) (*lbaas.LoadBalancer, error) {
-	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenExchanger)
+	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenSource)
 
 	LoadBalancer, _, err := m.client.LoadBalancersApi.GetLoadBalancer(ctx, id).Execute()
 	return LoadBalancer, err
 }
 
-// Returns a list of Load Balancer objects in the project
+// Returns a list of Load Balancer objects in the project, from all pages
 func (m *Manager) GetLoadBalancers(ctx context.Context) (*lbaas.LoadBalancerCollection, error) {
-	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenExchanger)
+	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenSource)
 
 	LoadBalancers, _, err := m.client.ProjectsApi.ListLoadBalancers(ctx, m.projectID).Execute()
+	if err != nil {
+		return nil, err
+	}
+	path := fmt.Sprintf("/v1/projects/%s/loadbalancers", url.PathEscape(m.projectID))
+	err = listNextPages(ctx, m, path, LoadBalancers.AdditionalProperties, func(page *lbaas.LoadBalancerCollection) map[string]interface{} {
+		LoadBalancers.Loadbalancers = append(LoadBalancers.Loadbalancers, page.Loadbalancers...)
+		return page.AdditionalProperties
+	})
 	return LoadBalancers, err
 }
 
+// Returns a list of Load Balancer Pool objects in the project, from all pages
 func (m *Manager) GetPools(ctx context.Context) (*lbaas.LoadBalancerPoolCollection, error) {
-	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenExchanger)
+	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenSource)
 
 	LoadBalancerPools, _, err := m.client.ProjectsApi.ListPools(ctx, m.projectID).Execute()
+	if err != nil {
+		return nil, err
+	}
+	path := fmt.Sprintf("/v1/projects/%s/loadbalancers/pools", url.PathEscape(m.projectID))
+	err = listNextPages(ctx, m, path, LoadBalancerPools.AdditionalProperties, func(page *lbaas.LoadBalancerPoolCollection) map[string]interface{} {
+		LoadBalancerPools.Pools = append(LoadBalancerPools.Pools, page.Pools...)
+		return page.AdditionalProperties
+	})
 	return LoadBalancerPools, err
 }
 
+// listNextPages gets the pages of a collection at path that follow the first one, whose properties are given,
+// and passes each to add, which returns its properties. It fails if a page links to one already listed.
+func listNextPages[C any](ctx context.Context, m *Manager, path string, properties map[string]interface{}, add func(page *C) map[string]interface{}) error {
+	seen := map[string]bool{}
+	for {
+		next, err := nextPage(properties)
+		if err != nil || next == "" {
+			return err
+		}
+		if seen[next] {
+			return fmt.Errorf("unable to list %s: page %s was already listed", path, next)
+		}
+		seen[next] = true
+		page := new(C)
+		if err := m.list(ctx, path+"?"+next, page); err != nil {
+			return err
+		}
+		properties = add(page)
+	}
+}
+
+// nextPage returns the query of the link to the page after a page of a collection, from its properties, or ""
+// if it is the last one. The generated client has neither page parameters nor page links, so the link is taken
+// from the meta.next.href property that the Equinix Metal APIs page collections with, and only its query is used,
+// as its path may or may not include the prefix of the server URL.
+func nextPage(properties map[string]interface{}) (string, error) {
+	meta, _ := properties["meta"].(map[string]interface{})
+	next, _ := meta["next"].(map[string]interface{})
+	href, ok := next["href"]
+	if !ok || href == nil {
+		return "", nil
+	}
+	link, ok := href.(string)
+	if !ok {
+		return "", fmt.Errorf("invalid next page link %v", href)
+	}
+	nextURL, err := url.Parse(link)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page link %q: %w", link, err)
+	}
+	if nextURL.RawQuery == "" {
+		return "", fmt.Errorf("next page link %q has no query", link)
+	}
+	return nextURL.RawQuery, nil
+}
+
 func (m *Manager) DeleteLoadBalancer(ctx context.Context, id string) error {
-	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenExchanger)
+	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenSource)
 
 	lb, _, err := m.client.LoadBalancersApi.GetLoadBalancer(ctx, id).Execute()
 
@@ -100,18 +168,18 @@ func (m *Manager) DeleteLoadBalancer(ctx context.Context, id string) error {
 }
 
 func (m *Manager) ReconcileLoadBalancer(ctx context.Context, id, name string, pools Pools) (*lbaas.LoadBalancer, error) {
-	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenExchanger)
+	ctx = context.WithValue(ctx, lbaas.ContextOAuth2, m.tokenSource)
 
 	if id == "" {
-		locationId, ok := LBMetros[m.metro]
-		if !ok {
-			return nil, fmt.Errorf("could not determine load balancer location for metro %v; valid values are %v", m.metro, reflect.ValueOf(LBMetros).MapKeys())
+		locationId, providerId, err := m.ResolveLocation(ctx)
+		if err != nil {
+			return nil, err
 		}
 
 		lbCreateRequest := lbaas.LoadBalancerCreate{
 			Name:       name,
 			LocationId: locationId,
-			ProviderId: ProviderID,
+			ProviderId: providerId,
 		}
 
 		lbCreated, _, err := m.client.ProjectsApi.CreateLoadBalancer(ctx, m.projectID).LoadBalancerCreate(lbCreateRequest).Execute()
@@ -138,28 +206,9 @@ func (m *Manager) ReconcileLoadBalancer(ctx context.Context, id, name string, po
 			existingPorts[portNumber] = struct{}{}
 
 			for _, existingPool := range existingPools[i] {
-				existingOrigins, _, err := m.client.PoolsApi.ListLoadBalancerPoolOrigins(ctx, existingPool.GetId()).Execute()
-				if err != nil {
+				if err := m.reconcileOrigins(ctx, existingPool.GetId(), existingPool.GetName(), targets); err != nil {
 					return nil, err
 				}
-
-				// TODO: can/should we be more granular here? figure out which to add and which to update?
-
-				// Create new origins for all targets
-				for j, target := range targets {
-					_, _, err := m.createOrigin(ctx, existingPool.GetId(), existingPool.GetName(), int32(j), target)
-					if err != nil {
-						return nil, err
-					}
-				}
-
-				// Delete old origins (some of which may be duplicates of the new ones)
-				for _, origin := range existingOrigins.GetOrigins() {
-					_, err := m.client.OriginsApi.DeleteLoadBalancerOrigin(ctx, origin.GetId()).Execute()
-					if err != nil {
-						return nil, err
-					}
-				}
 			}
 		} else {
 			// We have a pool for this port and we want to get rid of it
@@ -230,6 +279,118 @@ func (m *Manager) createPool(ctx context.Context, name string, targets []Target)
 	return poolID, nil
 }
 
+// reconcileOrigins changes the origins of a pool to the targets: origins of targets that are missing are created,
+// or if possible stale ones are updated to them, and the remaining stale origins are deleted, only once the
+// others are in place. Nothing is changed if the origins already match the targets.
+func (m *Manager) reconcileOrigins(ctx context.Context, poolID, poolName string, targets []Target) error {
+	existingOrigins, _, err := m.client.PoolsApi.ListLoadBalancerPoolOrigins(ctx, poolID).Execute()
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/v1/loadbalancers/pools/%s/origins", url.PathEscape(poolID))
+	err = listNextPages(ctx, m, path, existingOrigins.AdditionalProperties, func(page *lbaas.LoadBalancerPoolOriginCollection) map[string]interface{} {
+		existingOrigins.Origins = append(existingOrigins.Origins, page.Origins...)
+		return page.AdditionalProperties
+	})
+	if err != nil {
+		return err
+	}
+	diff := diffOrigins(existingOrigins.GetOrigins(), targets)
+
+	for _, update := range diff.update {
+		id, target := update.id, update.target
+		klog.V(2).Infof("updating origin %s of pool %s to %s:%d", id, poolName, target.IP, target.Port)
+		originUpdate := lbaas.LoadBalancerPoolOriginUpdate{
+			Target:     lbaas.PtrString(target.IP),
+			PortNumber: &lbaas.LoadBalancerPoolOriginPortNumber{Int32: lbaas.PtrInt32(target.Port)},
+			Active:     lbaas.PtrBool(true),
+		}
+		if _, _, err := m.client.OriginsApi.UpdateLoadBalancerOrigin(ctx, id).LoadBalancerPoolOriginUpdate(originUpdate).Execute(); err != nil {
+			return err
+		}
+	}
+	// created origins are numbered after the existing ones, whose names are not reused
+	names := map[string]bool{}
+	for _, origin := range existingOrigins.GetOrigins() {
+		names[origin.GetName()] = true
+	}
+	var number int32
+	for _, target := range diff.create {
+		for names[getResourceName(poolName, "origin", number)] {
+			number++
+		}
+		klog.V(2).Infof("creating origin of pool %s for %s:%d", poolName, target.IP, target.Port)
+		if _, _, err := m.createOrigin(ctx, poolID, poolName, number, target); err != nil {
+			return err
+		}
+		number++
+	}
+	for _, id := range diff.delete {
+		klog.V(2).Infof("deleting stale origin %s of pool %s", id, poolName)
+		if _, err := m.client.OriginsApi.DeleteLoadBalancerOrigin(ctx, id).Execute(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// originDiff holds the changes that make the origins of a pool match its targets
+type originDiff struct {
+	// create are the targets without an origin
+	create []Target
+	// update are the stale origins changed to targets without an origin
+	update []originUpdate
+	// delete are the IDs of the stale origins left
+	delete []string
+}
+
+type originUpdate struct {
+	id     string
+	target Target
+}
+
+// diffOrigins compares the origins of a pool to its targets. An active origin of a target is kept, and
+// any other is stale, including duplicates. Stale origins are updated to the targets without one, in
+// order, and the targets left are created.
+func diffOrigins(origins []lbaas.LoadBalancerPoolOrigin, targets []Target) *originDiff {
+	diff := &originDiff{}
+	wanted := map[Target]bool{}
+	for _, target := range targets {
+		wanted[target] = true
+	}
+
+	var stale []string
+	for _, origin := range origins {
+		target := Target{IP: origin.GetTarget()}
+		if port := origin.GetPortNumber(); port.Int32 != nil {
+			target.Port = *port.Int32
+		}
+		if origin.GetActive() && wanted[target] {
+			// later origins of the same target are duplicates
+			delete(wanted, target)
+			continue
+		}
+		stale = append(stale, origin.GetId())
+	}
+
+	for _, target := range targets {
+		if !wanted[target] {
+			continue
+		}
+		delete(wanted, target)
+		if len(stale) > 0 {
+			diff.update = append(diff.update, originUpdate{id: stale[0], target: target})
+			stale = stale[1:]
+		} else {
+			diff.create = append(diff.create, target)
+		}
+	}
+	if len(stale) > 0 {
+		diff.delete = stale
+	}
+	return diff
+}
+
 func (m *Manager) createOrigin(ctx context.Context, poolID, poolName string, number int32, target Target) (*lbaas.ResourceCreatedResponse, *http.Response, error) {
 	createOriginRequest := lbaas.LoadBalancerPoolOriginCreate{
 		Name:   getResourceName(poolName, "origin", number),
@@ -0,0 +1,173 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	lbaas "sigs.k8s.io/cloud-provider-equinix-metal/internal/lbaas/v1"
+)
+
+func testOrigin(id, ip string, port int32, active bool) lbaas.LoadBalancerPoolOrigin {
+	return lbaas.LoadBalancerPoolOrigin{
+		Id:         id,
+		Name:       "pool-origin-" + strings.TrimPrefix(id, "o"),
+		Target:     ip,
+		PortNumber: lbaas.LoadBalancerPoolOriginPortNumber{Int32: lbaas.PtrInt32(port)},
+		Active:     active,
+	}
+}
+
+func TestDiffOrigins(t *testing.T) {
+	a, b, c := Target{"10.0.0.1", 30000}, Target{"10.0.0.2", 30000}, Target{"10.0.0.3", 30000}
+	tests := []struct {
+		name    string
+		origins []lbaas.LoadBalancerPoolOrigin
+		targets []Target
+		diff    originDiff
+	}{
+		{"unchanged", []lbaas.LoadBalancerPoolOrigin{testOrigin("o0", a.IP, a.Port, true), testOrigin("o1", b.IP, b.Port, true)}, []Target{b, a}, originDiff{}},
+		{"new pool", nil, []Target{a, b}, originDiff{create: []Target{a, b}}},
+		{"added target", []lbaas.LoadBalancerPoolOrigin{testOrigin("o0", a.IP, a.Port, true)}, []Target{a, b}, originDiff{create: []Target{b}}},
+		{"removed target", []lbaas.LoadBalancerPoolOrigin{testOrigin("o0", a.IP, a.Port, true), testOrigin("o1", b.IP, b.Port, true)}, []Target{a}, originDiff{delete: []string{"o1"}}},
+		{"replaced target", []lbaas.LoadBalancerPoolOrigin{testOrigin("o0", a.IP, a.Port, true), testOrigin("o1", b.IP, b.Port, true)}, []Target{a, c}, originDiff{update: []originUpdate{{"o1", c}}}},
+		{"changed port", []lbaas.LoadBalancerPoolOrigin{testOrigin("o0", a.IP, 31000, true)}, []Target{a}, originDiff{update: []originUpdate{{"o0", a}}}},
+		{"inactive origin", []lbaas.LoadBalancerPoolOrigin{testOrigin("o0", a.IP, a.Port, false)}, []Target{a}, originDiff{update: []originUpdate{{"o0", a}}}},
+		{"duplicate origins", []lbaas.LoadBalancerPoolOrigin{testOrigin("o0", a.IP, a.Port, true), testOrigin("o1", a.IP, a.Port, true), testOrigin("o2", a.IP, a.Port, true)}, []Target{a, b}, originDiff{update: []originUpdate{{"o1", b}}, delete: []string{"o2"}}},
+		{"no targets", []lbaas.LoadBalancerPoolOrigin{testOrigin("o0", a.IP, a.Port, true)}, nil, originDiff{delete: []string{"o0"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := diffOrigins(tt.origins, tt.targets); !reflect.DeepEqual(*diff, tt.diff) {
+				t.Errorf("mismatched diff, actual %+v expected %+v", *diff, tt.diff)
+			}
+		})
+	}
+}
+
+func TestReconcileOrigins(t *testing.T) {
+	origins := `{"origins": [
+		{"id": "o0", "name": "pool-origin-0", "target": "10.0.0.1", "port_number": 30000, "active": true, "pool_id": "pool", "created_at": "2024-01-01T00:00:00Z", "updated_at": "2024-01-01T00:00:00Z"},
+		{"id": "o1", "name": "pool-origin-1", "target": "10.0.0.2", "port_number": 30000, "active": true, "pool_id": "pool", "created_at": "2024-01-01T00:00:00Z", "updated_at": "2024-01-01T00:00:00Z"}
+	]}`
+	tests := []struct {
+		name    string
+		targets []Target
+		calls   []string
+	}{
+		{"unchanged", []Target{{"10.0.0.1", 30000}, {"10.0.0.2", 30000}}, nil},
+		{"added target", []Target{{"10.0.0.1", 30000}, {"10.0.0.2", 30000}, {"10.0.0.3", 30000}}, []string{"POST /v1/loadbalancers/pools/pool/origins pool-origin-2"}},
+		{"replaced target", []Target{{"10.0.0.1", 30000}, {"10.0.0.3", 30000}}, []string{"PATCH /v1/loadbalancers/pools/origins/o1"}},
+		{"removed target", []Target{{"10.0.0.2", 30000}}, []string{"DELETE /v1/loadbalancers/pools/origins/o0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			mux := http.NewServeMux()
+			mux.HandleFunc("/exchange", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+			})
+			mux.HandleFunc("GET /v1/loadbalancers/pools/pool/origins", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(origins))
+			})
+			mux.HandleFunc("POST /v1/loadbalancers/pools/pool/origins", func(w http.ResponseWriter, r *http.Request) {
+				var origin lbaas.LoadBalancerPoolOriginCreate
+				if err := json.NewDecoder(r.Body).Decode(&origin); err != nil {
+					t.Errorf("invalid origin: %v", err)
+				}
+				calls = append(calls, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, origin.Name))
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id": "o2"}`))
+			})
+			mux.HandleFunc("/v1/loadbalancers/pools/origins/{id}", func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+				if r.Method == http.MethodDelete {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id": "o1", "name": "pool-origin-1", "target": "10.0.0.3", "port_number": 30000, "active": true, "pool_id": "pool", "created_at": "2024-01-01T00:00:00Z", "updated_at": "2024-01-01T00:00:00Z"}`))
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			m := NewManager("key", "project", "da", "location", "provider", server.URL, server.URL+"/exchange", server.Client())
+			ctx := context.WithValue(context.Background(), lbaas.ContextOAuth2, m.tokenSource)
+			if err := m.reconcileOrigins(ctx, "pool", "pool", tt.targets); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(calls, tt.calls) {
+				t.Errorf("mismatched calls, actual %v expected %v", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestGetLoadBalancersPages(t *testing.T) {
+	tests := []struct {
+		name     string
+		pages    []string
+		expected []string
+		err      bool
+	}{
+		{"single page", []string{`{"loadbalancers": [{"id": "lb1"}]}`}, []string{"lb1"}, false},
+		{"pages", []string{
+			`{"loadbalancers": [{"id": "lb1"}], "meta": {"next": {"href": "/v1/projects/project/loadbalancers?page=2"}}}`,
+			`{"loadbalancers": [{"id": "lb2"}], "meta": {"next": {"href": "/v1/projects/project/loadbalancers?page=3"}}}`,
+			`{"loadbalancers": [{"id": "lb3"}], "meta": {"next": null}}`,
+		}, []string{"lb1", "lb2", "lb3"}, false},
+		{"repeated page", []string{
+			`{"loadbalancers": [{"id": "lb1"}], "meta": {"next": {"href": "/v1/projects/project/loadbalancers?page=2"}}}`,
+			`{"loadbalancers": [{"id": "lb2"}], "meta": {"next": {"href": "/v1/projects/project/loadbalancers?page=2"}}}`,
+		}, nil, true},
+		{"invalid next page link", []string{`{"loadbalancers": [{"id": "lb1"}], "meta": {"next": {"href": 2}}}`}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/exchange", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+			})
+			mux.HandleFunc("GET /v1/projects/project/loadbalancers", func(w http.ResponseWriter, r *http.Request) {
+				page := 1
+				if p := r.URL.Query().Get("page"); p != "" {
+					_, _ = fmt.Sscan(p, &page)
+				}
+				if page > len(tt.pages) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(tt.pages[page-1]))
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			m := NewManager("key", "project", "da", "location", "provider", server.URL, server.URL+"/exchange", server.Client())
+			collection, err := m.GetLoadBalancers(context.Background())
+			if (err != nil) != tt.err {
+				t.Fatalf("mismatched error, actual %v expected error %t", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			var ids []string
+			for _, lb := range collection.GetLoadbalancers() {
+				ids = append(ids, lb.GetId())
+			}
+			if !slices.Equal(ids, tt.expected) {
+				t.Errorf("mismatched load balancers, actual %v expected %v", ids, tt.expected)
+			}
+		})
+	}
+}
@@ -2,22 +2,109 @@ package infrastructure
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
+	"k8s.io/klog/v2"
 )
 
+// DefaultTokenExchangeURL is the endpoint that exchanges a Metal API key for a token of the Load Balancer API
+const DefaultTokenExchangeURL = "https://iam.metalctrl.io/api-keys/exchange"
+
+const (
+	// tokenRefreshLeeway is how long before it expires a token is exchanged again, so that a request
+	// is never sent with a token that expires on the way. It is at most 1/tokenRefreshLeewayFraction of
+	// the lifetime of the token, so that a short-lived token is still reused.
+	tokenRefreshLeeway         = time.Minute
+	tokenRefreshLeewayFraction = 4
+	// defaultTokenLifetime is how long a token is reused if the exchange does not say when it expires
+	defaultTokenLifetime = 5 * time.Minute
+)
+
+// ErrInvalidToken is returned when the token exchange succeeds, but its response holds no usable token
+var ErrInvalidToken = errors.New("invalid token exchange response")
+
+// TokenExchangeError is returned when the token exchange endpoint rejects the exchange
+type TokenExchangeError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *TokenExchangeError) Error() string {
+	return fmt.Sprintf("token exchange request failed with status %d, body %s", e.StatusCode, e.Body)
+}
+
+// NewTokenSource returns a token source that exchanges the Metal API key for a token at url,
+// and reuses it until shortly before it expires
+func NewTokenSource(metalAPIKey, url string, client *http.Client) oauth2.TokenSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &reuseTokenSource{
+		exchanger: &TokenExchanger{
+			metalAPIKey: metalAPIKey,
+			url:         url,
+			client:      client,
+			now:         time.Now,
+		},
+	}
+}
+
+// reuseTokenSource reuses the token of the exchanger until its refresh leeway. Unlike
+// oauth2.ReuseTokenSourceWithExpiry, the leeway depends on the lifetime of each token.
+type reuseTokenSource struct {
+	exchanger *TokenExchanger
+	lock      sync.Mutex
+	token     *oauth2.Token
+	refreshAt time.Time
+}
+
+func (s *reuseTokenSource) Token() (*oauth2.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.exchanger.now()
+	if s.token != nil && now.Before(s.refreshAt) {
+		return s.token, nil
+	}
+	token, err := s.exchanger.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	s.refreshAt = token.Expiry.Add(-refreshLeeway(token.Expiry.Sub(now)))
+	return token, nil
+}
+
+// refreshLeeway returns how long before it expires a token with the lifetime is exchanged again
+func refreshLeeway(lifetime time.Duration) time.Duration {
+	return min(tokenRefreshLeeway, lifetime/tokenRefreshLeewayFraction)
+}
+
+// TokenExchanger exchanges a Metal API key for a token on every call; use NewTokenSource to reuse the token
 type TokenExchanger struct {
 	metalAPIKey string
+	url         string
 	client      *http.Client
+	// now is overridden in tests
+	now func() time.Time
+}
+
+// tokenExchangeResponse is the body of a successful token exchange. expires_in is decoded
+// as a float64, as JSON numbers are, so that it is accepted whether or not it has a fraction.
+type tokenExchangeResponse struct {
+	AccessToken string  `json:"access_token"`
+	TokenType   string  `json:"token_type"`
+	ExpiresIn   float64 `json:"expires_in"`
 }
 
 func (m *TokenExchanger) Token() (*oauth2.Token, error) {
-	tokenExchangeURL := "https://iam.metalctrl.io/api-keys/exchange"
-	tokenExchangeRequest, err := http.NewRequest("POST", tokenExchangeURL, nil)
+	tokenExchangeRequest, err := http.NewRequest("POST", m.url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -25,33 +112,37 @@ func (m *TokenExchanger) Token() (*oauth2.Token, error) {
 
 	resp, err := m.client.Do(tokenExchangeRequest)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("token exchange request failed: %w", err)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to read token exchange response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("token exchange request failed with status %v, body %v", resp.StatusCode, string(body[:]))
+		return nil, &TokenExchangeError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
-	token := oauth2.Token{}
-	err = json.Unmarshal(body, &token)
-	if err != nil {
-		fmt.Println(len(body))
-		fmt.Println(token)
-		fmt.Println(err)
-		return nil, err
+	var exchanged tokenExchangeResponse
+	if err := json.Unmarshal(body, &exchanged); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if exchanged.AccessToken == "" {
+		return nil, fmt.Errorf("%w: no access token", ErrInvalidToken)
 	}
 
-	expiresIn := token.Extra("expires_in")
-	if expiresIn != nil {
-		expiresInSeconds := expiresIn.(int)
-		token.Expiry = time.Now().Add(time.Second * time.Duration(expiresInSeconds))
+	token := &oauth2.Token{
+		AccessToken: exchanged.AccessToken,
+		TokenType:   exchanged.TokenType,
+	}
+	lifetime := defaultTokenLifetime
+	if exchanged.ExpiresIn > 0 {
+		lifetime = time.Duration(exchanged.ExpiresIn * float64(time.Second))
 	}
+	token.Expiry = m.now().Add(lifetime)
+	klog.V(2).Infof("exchanged API key for a Load Balancer API token, expires %s", token.Expiry.Format(time.RFC3339))
 
-	return &token, nil
+	return token, nil
 }
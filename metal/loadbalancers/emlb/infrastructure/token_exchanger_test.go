@@ -0,0 +1,120 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenSource(t *testing.T) {
+	var exchanges int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		exchanges++
+		_, _ = w.Write([]byte(`{"access_token": "token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	// the token is exchanged once, and reused until it expires
+	ts := NewTokenSource("key", server.URL, server.Client())
+	for range 3 {
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if token.AccessToken != "token" {
+			t.Errorf("mismatched token, actual %s expected token", token.AccessToken)
+		}
+	}
+	if exchanges != 1 {
+		t.Errorf("mismatched exchanges, actual %d expected 1", exchanges)
+	}
+
+	// a rejected exchange returns the status
+	_, err := NewTokenSource("other", server.URL, server.Client()).Token()
+	var exchangeErr *TokenExchangeError
+	if !errors.As(err, &exchangeErr) || exchangeErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("mismatched error, actual %v expected status %d", err, http.StatusUnauthorized)
+	}
+}
+
+func TestTokenSourceRefresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn int
+		reused    time.Duration
+		refreshed time.Duration
+	}{
+		// a token is exchanged again tokenRefreshLeeway before it expires
+		{"long lifetime", 3600, time.Hour - tokenRefreshLeeway - time.Second, time.Hour - tokenRefreshLeeway},
+		// or, if that is shorter, a quarter of its lifetime before, rather than on every call
+		{"short lifetime", 30, 22 * time.Second, 23 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var exchanges int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				exchanges++
+				_, _ = fmt.Fprintf(w, `{"access_token": "token", "token_type": "Bearer", "expires_in": %d}`, tt.expiresIn)
+			}))
+			defer server.Close()
+
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			now := start
+			ts := &reuseTokenSource{exchanger: &TokenExchanger{metalAPIKey: "key", url: server.URL, client: server.Client(), now: func() time.Time { return now }}}
+			for _, step := range []struct {
+				at        time.Duration
+				exchanges int
+			}{{0, 1}, {0, 1}, {tt.reused, 1}, {tt.refreshed, 2}, {tt.refreshed, 2}} {
+				now = start.Add(step.at)
+				if _, err := ts.Token(); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if exchanges != step.exchanges {
+					t.Errorf("mismatched exchanges after %s, actual %d expected %d", step.at, exchanges, step.exchanges)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenExchangerResponse(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		body   string
+		expiry time.Time
+		err    error
+	}{
+		{"integer expiry", `{"access_token": "token", "expires_in": 60}`, now.Add(time.Minute), nil},
+		{"fractional expiry", `{"access_token": "token", "expires_in": 1.5}`, now.Add(1500 * time.Millisecond), nil},
+		{"no expiry", `{"access_token": "token"}`, now.Add(defaultTokenLifetime), nil},
+		{"no access token", `{"expires_in": 60}`, time.Time{}, ErrInvalidToken},
+		{"invalid json", `{]`, time.Time{}, ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			exchanger := &TokenExchanger{metalAPIKey: "key", url: server.URL, client: server.Client(), now: func() time.Time { return now }}
+			token, err := exchanger.Token()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("mismatched error, actual %v expected %v", err, tt.err)
+			}
+			if err == nil && !token.Expiry.Equal(tt.expiry) {
+				t.Errorf("mismatched expiry, actual %s expected %s", token.Expiry, tt.expiry)
+			}
+		})
+	}
+}
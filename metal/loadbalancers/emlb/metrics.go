@@ -0,0 +1,40 @@
+package emlb
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	reconcileDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      "equinix_metal",
+			Name:           "emlb_reconcile_duration_seconds",
+			Help:           "Duration of the reconciliations of Equinix Metal Load Balancers, by operation and result.",
+			Buckets:        metrics.ExponentialBuckets(0.1, 2, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation", "result"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the metrics of the load balancer with the registry that the CCM serves on its metrics endpoint
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(reconcileDuration)
+	})
+}
+
+// observeReconcile records the duration of an operation since start, and whether it failed with err
+func observeReconcile(operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	reconcileDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
@@ -17,11 +17,11 @@ func NewLB(k8sclient kubernetes.Interface, config string) *LB {
 	return &LB{}
 }
 
-func (l *LB) AddService(ctx context.Context, svcNamespace, svcName, ip string, nodes []loadbalancers.Node, svc *v1.Service, n []*v1.Node, loadBalancerName string) error {
+func (l *LB) AddService(ctx context.Context, svcNamespace, svcName string, ips []string, nodes []loadbalancers.Node, svc *v1.Service, n []*v1.Node, loadBalancerName string) error {
 	return nil
 }
 
-func (l *LB) RemoveService(ctx context.Context, svcNamespace, svcName, ip string, svc *v1.Service) error {
+func (l *LB) RemoveService(ctx context.Context, svcNamespace, svcName string, ips []string, svc *v1.Service) error {
 	return nil
 }
 
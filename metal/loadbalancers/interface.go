@@ -7,10 +7,10 @@ import (
 )
 
 type LB interface {
-	// AddService add a service with the provided name and IP
-	AddService(ctx context.Context, svcNamespace, svcName, ip string, nodes []Node, svc *v1.Service, n []*v1.Node, loadBalancerName string) error
-	// RemoveService remove service with the given IP
-	RemoveService(ctx context.Context, svcNamespace, svcName, ip string, svc *v1.Service) error
+	// AddService add a service with the provided name and IPs, one per IP family
+	AddService(ctx context.Context, svcNamespace, svcName string, ips []string, nodes []Node, svc *v1.Service, n []*v1.Node, loadBalancerName string) error
+	// RemoveService remove service with the given IPs
+	RemoveService(ctx context.Context, svcNamespace, svcName string, ips []string, svc *v1.Service) error
 	// UpdateService ensure that the nodes handled by the service are correct
 	UpdateService(ctx context.Context, svcNamespace, svcName string, nodes []Node, svc *v1.Service, n []*v1.Node) error
 	// GetLoadBalancer implements cloudprovider.GetLoadBalancer
@@ -347,7 +347,33 @@ func (m *CRDConfigurer) Get(ctx context.Context) error { return nil }
 
 func (m *CRDConfigurer) Update(ctx context.Context) error { return nil }
 
-// RemoveAddressPooByAddress remove a pool by an address name. If the matching pool does not exist, do not change anything
+// RemoveAddressPoolByAddress removes an address from the pools that have it, and removes the pools left
+// without addresses. If no pool has the address, do not change anything
 func (m *CRDConfigurer) RemoveAddressPoolByAddress(ctx context.Context, addrName string) error {
+	if addrName == "" {
+		return nil
+	}
+
+	olds, err := m.listIPAddressPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range olds.Items {
+		if !slices.Contains(o.Spec.Addresses, addrName) {
+			continue
+		}
+		if len(o.Spec.Addresses) == 1 {
+			if err := m.RemoveAddressPool(ctx, o.GetName()); err != nil {
+				return err
+			}
+			continue
+		}
+		patch := client.MergeFrom(o.DeepCopy())
+		o.Spec.Addresses = slices.DeleteFunc(o.Spec.Addresses, func(addr string) bool { return addr == addrName })
+		if err := m.client.Patch(ctx, &o, patch); err != nil {
+			return fmt.Errorf("unable to update IPAddressPool %s: %w", o.GetName(), err)
+		}
+	}
 	return nil
 }
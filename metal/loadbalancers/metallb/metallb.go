@@ -3,6 +3,7 @@ package metallb
 import (
 	"context"
 	"fmt"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
@@ -116,14 +117,14 @@ func NewLB(k8sclient kubernetes.Interface, config string, featureFlags url.Value
 	return lb
 }
 
-func (l *LB) AddService(ctx context.Context, svcNamespace, svcName, ip string, nodes []loadbalancers.Node, svc *v1.Service, n []*v1.Node, loadBalancerName string) error {
+func (l *LB) AddService(ctx context.Context, svcNamespace, svcName string, ips []string, nodes []loadbalancers.Node, svc *v1.Service, n []*v1.Node, loadBalancerName string) error {
 	config := l.configurer
 	if err := config.Get(ctx); err != nil {
 		return fmt.Errorf("unable to add service: %w", err)
 	}
 
 	// Update the service and configmap/IpAddressPool and save them
-	if err := addIP(ctx, config, ip, svcNamespace, svcName, l.configurerType); err != nil {
+	if err := addIP(ctx, config, ips, svcNamespace, svcName, l.configurerType); err != nil {
 		return fmt.Errorf("unable to map IP to service: %w", err)
 	}
 	if err := l.updateNodes(ctx, svcNamespace, svcName, nodes); err != nil {
@@ -132,14 +133,14 @@ func (l *LB) AddService(ctx context.Context, svcNamespace, svcName, ip string, n
 	return nil
 }
 
-func (l *LB) RemoveService(ctx context.Context, svcNamespace, svcName, ip string, svc *v1.Service) error {
+func (l *LB) RemoveService(ctx context.Context, svcNamespace, svcName string, ips []string, svc *v1.Service) error {
 	config := l.configurer
 	if err := config.Get(ctx); err != nil {
 		return fmt.Errorf("unable to remove service: %w", err)
 	}
 
 	// remove the EIP
-	if err := removeIP(ctx, config, ip, svcNamespace, svcName, l.configurerType); err != nil {
+	if err := removeIP(ctx, config, ips, svcNamespace, svcName, l.configurerType); err != nil {
 		return fmt.Errorf("failed to remove IP: %w", err)
 	}
 
@@ -195,7 +196,7 @@ func (l *LB) updateNodes(ctx context.Context, svcNamespace, svcName string, node
 				NodeSelectors: ns,
 			}
 			if crdConfiguration {
-				p.Name = fmt.Sprintf("%s-%d", node.Name, i)
+				p.Name = peerName(node.Name, peer, i)
 				// TODO (ocobleseqx) could it be another port num?
 				p.Port = 179
 			}
@@ -217,19 +218,28 @@ func (l *LB) updateNodes(ctx context.Context, svcNamespace, svcName string, node
 	return nil
 }
 
-// addIP add a given ip address to the metallb ConfigMap or IPAddressPool
-func addIP(ctx context.Context, config Configurer, addr, svcNamespace, svcName, configurerType string) error {
-	klog.V(2).Infof("mapping IP %s", addr)
-	return updateIP(ctx, config, addr, svcNamespace, svcName, configurerType, true)
+// peerName returns the name of the i-th BGPPeer of a node. IPv6 peers are named apart
+// from IPv4 peers, so that a node can have peers of both families.
+func peerName(nodeName, addr string, i int) string {
+	if ip, err := netip.ParseAddr(addr); err == nil && ip.Is6() {
+		return fmt.Sprintf("%s-ipv6-%d", nodeName, i)
+	}
+	return fmt.Sprintf("%s-%d", nodeName, i)
+}
+
+// addIP add the given ip addresses of a service to the metallb ConfigMap or IPAddressPool
+func addIP(ctx context.Context, config Configurer, addrs []string, svcNamespace, svcName, configurerType string) error {
+	klog.V(2).Infof("mapping IPs %v", addrs)
+	return updateIP(ctx, config, addrs, svcNamespace, svcName, configurerType, true)
 }
 
-// removeIP remove a given IP address from the metalllb ConfigMap or IPAddressPool
-func removeIP(ctx context.Context, config Configurer, addr, svcNamespace, svcName, configurerType string) error {
-	klog.V(2).Infof("unmapping IP %s", addr)
-	return updateIP(ctx, config, addr, svcNamespace, svcName, configurerType, false)
+// removeIP remove the given IP addresses of a service from the metalllb ConfigMap or IPAddressPool
+func removeIP(ctx context.Context, config Configurer, addrs []string, svcNamespace, svcName, configurerType string) error {
+	klog.V(2).Infof("unmapping IPs %v", addrs)
+	return updateIP(ctx, config, addrs, svcNamespace, svcName, configurerType, false)
 }
 
-func updateIP(ctx context.Context, config Configurer, addr, svcNamespace, svcName, configurerType string, add bool) error {
+func updateIP(ctx context.Context, config Configurer, addrs []string, svcNamespace, svcName, configurerType string, add bool) error {
 	if config == nil {
 		klog.V(2).Info("config unchanged, not updating")
 		return nil
@@ -249,7 +259,7 @@ func updateIP(ctx context.Context, config Configurer, addr, svcNamespace, svcNam
 		added, err := config.AddAddressPool(ctx, &AddressPool{
 			Protocol:   "bgp",
 			Name:       name,
-			Addresses:  []string{addr},
+			Addresses:  addrs,
 			AutoAssign: &autoAssign,
 		}, svcNamespace, svcName)
 		if err != nil {
@@ -261,16 +271,13 @@ func updateIP(ctx context.Context, config Configurer, addr, svcNamespace, svcNam
 			return nil
 		}
 	} else {
-		if !crdConfiguration {
+		// pools are removed by address rather than by name, as a pool may hold an address that
+		// other services share, and that is not passed here until the last of them is removed
+		for _, addr := range addrs {
 			if err := config.RemoveAddressPoolByAddress(ctx, addr); err != nil {
 				klog.V(2).Infof("error removing IP: %v", err)
 				return fmt.Errorf("error removing IP: %w", err)
 			}
-		} else {
-			if err := config.RemoveAddressPool(ctx, name); err != nil {
-				klog.V(2).Infof("error removing IPAddressPool: %v", err)
-				return fmt.Errorf("error removing IPAddressPool: %w", err)
-			}
 		}
 	}
 
@@ -0,0 +1,18 @@
+package metallb
+
+import "testing"
+
+func TestPeerName(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"169.254.255.1", "node1-0"},
+		{"2604:1380:4641:c500::1", "node1-ipv6-0"},
+	}
+	for _, tt := range tests {
+		if name := peerName("node1", tt.addr, 0); name != tt.expected {
+			t.Errorf("%s: mismatched name, actual %s expected %s", tt.addr, name, tt.expected)
+		}
+	}
+}
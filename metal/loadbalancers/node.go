@@ -1,5 +1,12 @@
 package loadbalancers
 
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// TaintSpotTermination is the taint key put on nodes of spot market devices that are about to be terminated
+const TaintSpotTermination = "metal.equinix.com/spot-termination"
+
 type Node struct {
 	Name     string
 	SourceIP string
@@ -8,3 +15,13 @@ type Node struct {
 	Password string
 	Peers    []string
 }
+
+// IsTerminating returns true if the node is tainted for termination, and so should not receive load balancer traffic
+func IsTerminating(node *v1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == TaintSpotTermination {
+			return true
+		}
+	}
+	return false
+}
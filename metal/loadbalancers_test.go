@@ -0,0 +1,334 @@
+package metal
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+
+	"sigs.k8s.io/cloud-provider-equinix-metal/metal/loadbalancers/empty"
+)
+
+func TestServiceIPFamilies(t *testing.T) {
+	tests := []struct {
+		name     string
+		families []v1.IPFamily
+		policy   *v1.IPFamilyPolicy
+		expected []v1.IPFamily
+	}{
+		{"unset", nil, nil, []v1.IPFamily{v1.IPv4Protocol}},
+		{"IPv4", []v1.IPFamily{v1.IPv4Protocol}, ptr.To(v1.IPFamilyPolicySingleStack), []v1.IPFamily{v1.IPv4Protocol}},
+		{"IPv6", []v1.IPFamily{v1.IPv6Protocol}, ptr.To(v1.IPFamilyPolicySingleStack), []v1.IPFamily{v1.IPv6Protocol}},
+		{"prefer dual-stack", []v1.IPFamily{v1.IPv4Protocol}, ptr.To(v1.IPFamilyPolicyPreferDualStack), []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}},
+		{"require dual-stack", []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}, ptr.To(v1.IPFamilyPolicyRequireDualStack), []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}},
+		{"require dual-stack IPv6 primary", []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}, ptr.To(v1.IPFamilyPolicyRequireDualStack), []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{Spec: v1.ServiceSpec{IPFamilies: tt.families, IPFamilyPolicy: tt.policy}}
+			if families := serviceIPFamilies(svc); !slices.Equal(families, tt.expected) {
+				t.Errorf("mismatched families, actual %v expected %v", families, tt.expected)
+			}
+		})
+	}
+}
+
+func TestServiceEIPFamilies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *v1.IPFamilyPolicy
+		ingress  []string
+		expected []v1.IPFamily
+	}{
+		{"no EIP", nil, nil, nil},
+		{"IPv4", nil, []string{"147.75.100.1"}, []v1.IPFamily{v1.IPv4Protocol}},
+		{"prefer dual-stack with IPv4 only", ptr.To(v1.IPFamilyPolicyPreferDualStack), []string{"147.75.100.1"}, []v1.IPFamily{v1.IPv4Protocol}},
+		{"dual-stack", ptr.To(v1.IPFamilyPolicyRequireDualStack), []string{"2604:1380:4641:c500::10", "147.75.100.1"}, []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}},
+		{"ingress hostname", nil, []string{""}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{Spec: v1.ServiceSpec{IPFamilies: []v1.IPFamily{v1.IPv4Protocol}, IPFamilyPolicy: tt.policy}}
+			for _, ip := range tt.ingress {
+				svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: ip})
+			}
+			if families := serviceEIPFamilies(svc); !slices.Equal(families, tt.expected) {
+				t.Errorf("mismatched families, actual %v expected %v", families, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUpdateLoadBalancerSkipsNodes(t *testing.T) {
+	vc, _ := testGetValidCloud(t, "")
+	k8sclient := k8sfake.NewSimpleClientset()
+	l := &loadBalancers{client: vc.client, k8sclient: k8sclient, recorder: &record.FakeRecorder{}, project: vc.config.ProjectID, clusterID: "cluster1", usesBGP: true, nodeSelector: labels.Everything(), implementor: empty.NewLB(k8sclient, "")}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "svc"},
+		Spec:       v1.ServiceSpec{IPFamilies: []v1.IPFamily{v1.IPv4Protocol}, IPFamilyPolicy: ptr.To(v1.IPFamilyPolicyPreferDualStack)},
+		Status:     v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "147.75.100.1"}}}},
+	}
+
+	// a node whose BGP peers cannot be found is skipped, as by addService, rather than failing every update
+	if err := l.UpdateLoadBalancer(context.Background(), "", svc, []*v1.Node{testNode("", "uninitialized")}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGetLoadBalancerDualStack(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	l := &loadBalancers{client: vc.client, recorder: &record.FakeRecorder{}, project: vc.config.ProjectID, clusterID: "cluster1", usesBGP: true}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dual"},
+		Spec: v1.ServiceSpec{
+			IPFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+			IPFamilyPolicy: ptr.To(v1.IPFamilyPolicyRequireDualStack),
+		},
+	}
+	tags := []string{emTag, serviceTag(svc), clusterTag(l.clusterID)}
+	server.IPReservationStore[vc.config.ProjectID] = &metal.IPReservationList{
+		IpAddresses: []metal.IPReservationListIpAddressesInner{
+			{IPReservation: &metal.IPReservation{Address: metal.PtrString("147.75.100.1"), Tags: tags}},
+			{IPReservation: &metal.IPReservation{Address: metal.PtrString("147.75.100.2"), Tags: []string{emTag}}},
+			{IPReservation: &metal.IPReservation{Address: metal.PtrString("2604:1380:4641:c500::10"), Tags: tags}},
+		},
+	}
+
+	status, exists, err := l.GetLoadBalancer(context.Background(), "", svc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exists {
+		t.Fatal("expected load balancer to exist")
+	}
+	var ingress []string
+	for _, i := range status.Ingress {
+		ingress = append(ingress, i.IP)
+	}
+	expected := []string{"2604:1380:4641:c500::10", "147.75.100.1"}
+	if !slices.Equal(ingress, expected) {
+		t.Errorf("mismatched ingress, actual %v expected %v", ingress, expected)
+	}
+}
+
+func TestIPReservationTypeGlobal(t *testing.T) {
+	tests := []struct {
+		annotation string
+		family     v1.IPFamily
+		expected   string
+		valid      bool
+	}{
+		{"", v1.IPv4Protocol, "public_ipv4", true},
+		{"false", v1.IPv4Protocol, "public_ipv4", true},
+		{"true", v1.IPv4Protocol, "global_ipv4", true},
+		{"", v1.IPv6Protocol, "public_ipv6", true},
+		{"yes", v1.IPv4Protocol, "", false},
+	}
+
+	for i, tt := range tests {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{DefaultAnnotationEIPGlobal: tt.annotation}}}
+		global, err := serviceGlobalIP(svc, DefaultAnnotationEIPGlobal)
+		switch {
+		case err != nil && tt.valid:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case err == nil && !tt.valid:
+			t.Errorf("%d: expected error for annotation %q", i, tt.annotation)
+		case err == nil && ipReservationType(tt.family, global) != tt.expected:
+			t.Errorf("%d: mismatched type, actual %s expected %s", i, ipReservationType(tt.family, global), tt.expected)
+		}
+	}
+}
+
+func TestBindIPReservation(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	ctx := context.Background()
+	bound := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "bound", Annotations: map[string]string{DefaultAnnotationEIPReservationID: "r1"}},
+	}
+	other := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other", Annotations: map[string]string{DefaultAnnotationEIPReservationTag: "customer"}},
+	}
+	k8sclient := k8sfake.NewSimpleClientset(bound, other)
+	recorder := record.NewFakeRecorder(10)
+	l := &loadBalancers{
+		client:                      vc.client,
+		k8sclient:                   k8sclient,
+		recorder:                    recorder,
+		project:                     vc.config.ProjectID,
+		clusterID:                   "cluster1",
+		implementor:                 empty.NewLB(k8sclient, ""),
+		eipReservationIDAnnotation:  DefaultAnnotationEIPReservationID,
+		eipReservationTagAnnotation: DefaultAnnotationEIPReservationTag,
+		usesBGP:                     true,
+	}
+	reservation := &metal.IPReservation{Id: metal.PtrString("r1"), Address: metal.PtrString("147.75.100.1"), Cidr: metal.PtrInt32(32), Tags: []string{"customer"}}
+	server.IPReservationStore[vc.config.ProjectID] = &metal.IPReservationList{
+		IpAddresses: []metal.IPReservationListIpAddressesInner{{IPReservation: reservation}},
+	}
+
+	// the bound service adopts the reservation
+	ips, err := listIPReservations(ctx, vc.client, vc.config.ProjectID)
+	if err != nil {
+		t.Fatalf("unable to list reservations: %v", err)
+	}
+	svcIPCidr, err := l.ensureServiceIP(ctx, bound, v1.IPv4Protocol, true, ips)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if svcIPCidr != "147.75.100.1/32" {
+		t.Errorf("mismatched IP, actual %s expected 147.75.100.1/32", svcIPCidr)
+	}
+	for _, tag := range []string{"customer", emTag, serviceTag(bound), clusterTag(l.clusterID), adoptedTag} {
+		if !slices.Contains(reservation.Tags, tag) {
+			t.Errorf("adopted reservation missing tag %s, has %v", tag, reservation.Tags)
+		}
+	}
+	updated, err := k8sclient.CoreV1().Services(bound.Namespace).Get(ctx, bound.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get service: %v", err)
+	}
+	if updated.Spec.LoadBalancerIP != "147.75.100.1" {
+		t.Errorf("mismatched service IP, actual %s expected 147.75.100.1", updated.Spec.LoadBalancerIP)
+	}
+
+	// another service cannot adopt the same reservation
+	ips, err = listIPReservations(ctx, vc.client, vc.config.ProjectID)
+	if err != nil {
+		t.Fatalf("unable to list reservations: %v", err)
+	}
+	if _, err := l.ensureServiceIP(ctx, other, v1.IPv4Protocol, true, ips); err == nil {
+		t.Error("expected error adopting a reservation in use by another service")
+	}
+
+	// deleting the bound service releases, rather than deletes, the reservation
+	if err := l.EnsureLoadBalancerDeleted(ctx, "", bound); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	remaining := server.IPReservationStore[vc.config.ProjectID].IpAddresses
+	if len(remaining) != 1 {
+		t.Fatalf("mismatched reservations, actual %d expected 1", len(remaining))
+	}
+	if tags := remaining[0].IPReservation.Tags; !slices.Equal(tags, []string{"customer"}) {
+		t.Errorf("mismatched tags of released reservation, actual %v expected [customer]", tags)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, eventReasonEIPReleased) {
+			t.Errorf("mismatched event, actual %q expected %s", event, eventReasonEIPReleased)
+		}
+	default:
+		t.Errorf("expected event %s", eventReasonEIPReleased)
+	}
+}
+
+func TestShareIPReservation(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	ctx := context.Background()
+	annotations := map[string]string{DefaultAnnotationEIPSharingKey: "dns"}
+	tcp := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns-tcp", Annotations: annotations}}
+	udp := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns-udp", Annotations: annotations}}
+	other := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "dns-tcp", Annotations: annotations}}
+	k8sclient := k8sfake.NewSimpleClientset(tcp, udp, other)
+	l := &loadBalancers{
+		client:                  vc.client,
+		k8sclient:               k8sclient,
+		recorder:                &record.FakeRecorder{},
+		project:                 vc.config.ProjectID,
+		metro:                   "ny",
+		clusterID:               "cluster1",
+		implementor:             empty.NewLB(k8sclient, ""),
+		eipSharingKeyAnnotation: DefaultAnnotationEIPSharingKey,
+		usesBGP:                 true,
+	}
+
+	ensure := func(svc *v1.Service) string {
+		t.Helper()
+		ips, err := listIPReservations(ctx, vc.client, vc.config.ProjectID)
+		if err != nil {
+			t.Fatalf("unable to list reservations: %v", err)
+		}
+		svcIPCidr, err := l.ensureServiceIP(ctx, svc, v1.IPv4Protocol, true, ips)
+		if err != nil {
+			t.Fatalf("unexpected error for service %s: %v", serviceRep(svc), err)
+		}
+		return svcIPCidr
+	}
+
+	// services of a namespace with the same sharing key share a reservation
+	tcpIP, udpIP, otherIP := ensure(tcp), ensure(udp), ensure(other)
+	if tcpIP != udpIP {
+		t.Errorf("mismatched shared IPs, %s and %s", tcpIP, udpIP)
+	}
+	if otherIP == tcpIP {
+		t.Errorf("service in another namespace shares IP %s", otherIP)
+	}
+	reservations := server.IPReservationStore[vc.config.ProjectID]
+	if len(reservations.IpAddresses) != 2 {
+		t.Fatalf("mismatched reservations, actual %d expected 2", len(reservations.IpAddresses))
+	}
+	shared := reservations.IpAddresses[0].IPReservation
+	for _, tag := range []string{serviceTag(tcp), serviceTag(udp), sharingKeyTag(tcp, DefaultAnnotationEIPSharingKey)} {
+		if !slices.Contains(shared.Tags, tag) {
+			t.Errorf("shared reservation missing tag %s, has %v", tag, shared.Tags)
+		}
+	}
+
+	// the reservation is kept until the last service that shares it is deleted
+	if err := l.EnsureLoadBalancerDeleted(ctx, "", tcp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reservations.IpAddresses) != 2 {
+		t.Fatalf("shared reservation deleted while still in use")
+	}
+	if slices.Contains(shared.Tags, serviceTag(tcp)) {
+		t.Errorf("shared reservation still tagged for deleted service, has %v", shared.Tags)
+	}
+	if err := l.EnsureLoadBalancerDeleted(ctx, "", udp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reservations.IpAddresses) != 1 || reservations.IpAddresses[0].IPReservation == shared {
+		t.Errorf("shared reservation not deleted with the last service")
+	}
+}
+
+func TestSaveServiceIPAnnotation(t *testing.T) {
+	ctx := context.Background()
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "svc"}}
+	k8sclient := k8sfake.NewClientset(svc)
+	l := &loadBalancers{
+		k8sclient:             k8sclient,
+		recorder:              &record.FakeRecorder{},
+		eipAssignedAnnotation: DefaultAnnotationEIPAssigned,
+		eipAssignment:         eipAssignmentAnnotation,
+	}
+
+	if err := l.saveServiceIP(ctx, svc, "147.75.100.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated, err := k8sclient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get service: %v", err)
+	}
+	if updated.Spec.LoadBalancerIP != "" {
+		t.Errorf("load balancer IP set to %s with annotation assignment", updated.Spec.LoadBalancerIP)
+	}
+	if ip := l.serviceIP(updated); ip != "147.75.100.1" {
+		t.Errorf("mismatched service IP, actual %s expected 147.75.100.1", ip)
+	}
+
+	// a load balancer IP set by the user takes precedence
+	updated.Spec.LoadBalancerIP = "147.75.100.2"
+	if ip := l.serviceIP(updated); ip != "147.75.100.2" {
+		t.Errorf("mismatched service IP, actual %s expected 147.75.100.2", ip)
+	}
+}
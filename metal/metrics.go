@@ -0,0 +1,133 @@
+package metal
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// metricsSubsystem prefixes the names of the metrics of the provider
+const metricsSubsystem = "equinix_metal"
+
+var (
+	apiRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "api_request_duration_seconds",
+			Help:           "Latency of the requests to the Equinix Metal APIs, by method, endpoint and status code, each retry counted separately.",
+			Buckets:        metrics.ExponentialBuckets(0.05, 2, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"method", "endpoint", "code"},
+	)
+	eipReservationsRequested = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "eip_reservations_requested_total",
+			Help:           "Number of IP reservations requested for services, including shared EIP blocks.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	eipReservationsReleased = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "eip_reservations_released_total",
+			Help:           "Number of IP reservations of services deleted, or released if they were adopted.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"action"},
+	)
+	controlPlaneHealthChecks = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "controlplane_health_checks_total",
+			Help:           "Number of health checks of the control plane through its EIP, by result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+	controlPlaneFailovers = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "controlplane_eip_failovers_total",
+			Help:           "Number of attempts to reassign the control plane EIP to a healthy node, by result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+	bgpSessionFailures = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "bgp_session_enablement_failures_total",
+			Help:           "Number of failures to enable BGP sessions on devices.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the metrics of the provider with the registry that the CCM serves on its metrics endpoint
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(
+			apiRequestDuration,
+			eipReservationsRequested,
+			eipReservationsReleased,
+			controlPlaneHealthChecks,
+			controlPlaneFailovers,
+			bgpSessionFailures,
+		)
+	})
+}
+
+// result returns the label of the result of an operation that failed with err
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// instrumentedTransport records the latency of the requests that it sends with base
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequestDuration.WithLabelValues(req.Method, apiEndpoint(req.URL.Path), code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// apiEndpoint returns the path of a request with the IDs replaced, so that the endpoint label has few values
+func apiEndpoint(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isAPIID(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isAPIID returns true if a path segment is an ID: a UUID, as in the Metal API, or a long
+// segment with digits, as in the Load Balancer API, for example lctnloc-Vy-1Qpw31mPi6RJQwVf9A
+func isAPIID(segment string) bool {
+	if _, err := uuid.Parse(segment); err == nil {
+		return true
+	}
+	return len(segment) >= 16 && strings.ContainsAny(segment, "0123456789")
+}
@@ -0,0 +1,58 @@
+package metal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestAPIEndpoint(t *testing.T) {
+	tests := []struct {
+		path     string
+		endpoint string
+	}{
+		{"/metal/v1/projects/6b8e1a0c-23a4-4d84-9d4b-3c5e7b2f8a10/ips", "/metal/v1/projects/{id}/ips"},
+		{"/metal/v1/ips/9a4e39c4-61c1-4a6d-8a0f-0e7e4b7b3d52", "/metal/v1/ips/{id}"},
+		{"/metal/v1/devices/9a4e39c4-61c1-4a6d-8a0f-0e7e4b7b3d52/bgp/neighbors", "/metal/v1/devices/{id}/bgp/neighbors"},
+		{"/v1/locations/lctnloc-Vy-1Qpw31mPi6RJQwVf9A/loadbalancers", "/v1/locations/{id}/loadbalancers"},
+		{"/metal/v1/hardware-reservations", "/metal/v1/hardware-reservations"},
+	}
+
+	for _, tt := range tests {
+		if endpoint := apiEndpoint(tt.path); endpoint != tt.endpoint {
+			t.Errorf("mismatched endpoint of %s, actual %s expected %s", tt.path, endpoint, tt.endpoint)
+		}
+	}
+}
+
+func TestInstrumentedTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	// metrics record nothing until they are registered
+	registerMetrics()
+	observer := apiRequestDuration.WithLabelValues(http.MethodGet, "/metal/v1/ips/{id}", "429")
+	before, err := testutil.GetHistogramMetricCount(observer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := &http.Client{Transport: instrumentedTransport{base: http.DefaultTransport}}
+	resp, err := client.Get(server.URL + "/metal/v1/ips/9a4e39c4-61c1-4a6d-8a0f-0e7e4b7b3d52")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	after, err := testutil.GetHistogramMetricCount(observer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after != before+1 {
+		t.Errorf("mismatched requests, actual %d expected %d", after-before, 1)
+	}
+}
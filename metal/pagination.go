@@ -0,0 +1,59 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+)
+
+// nextPage returns the link to the page after the one with the meta, or "" if it is the last one
+func nextPage(meta *metal.Meta) string {
+	next := meta.GetNext()
+	return next.GetHref()
+}
+
+// getNextPage gets the page of a collection at path, of which next is the link from the previous page,
+// into page. It is for the list operations of the SDK that take no page number, such as FindIPReservations
+// and GetVrfRoutes of equinix-sdk-go v0.61.0, whose following pages can only be reached through the link.
+// Only the query of the link is used, as its path may or may not include the prefix of the server URL.
+func getNextPage(ctx context.Context, client *metal.APIClient, path, next string, page any) error {
+	nextURL, err := url.Parse(next)
+	if err != nil {
+		return fmt.Errorf("invalid next page link %q: %w", next, err)
+	}
+	config := client.GetConfig()
+	serverURL, err := config.ServerURLWithContext(ctx, "")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+path+"?"+nextURL.RawQuery, nil)
+	if err != nil {
+		return err
+	}
+	for header, value := range config.DefaultHeader {
+		req.Header.Set(header, value)
+	}
+	req.Header.Set("Accept", "application/json")
+	if config.UserAgent != "" {
+		req.Header.Set("User-Agent", config.UserAgent)
+	}
+
+	resp, err := config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s failed with status %d, body %s", path, resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, page)
+}
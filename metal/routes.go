@@ -0,0 +1,175 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// routes implements cloudprovider.Routes with static routes in an Equinix Metal VRF.
+// Each route sends the pod CIDR of a node to the node's internal address of the same
+// IP family, which must be an address in the VRF, e.g. set with the kubelet option --node-ip.
+//
+// Routes are tagged with emTag, the cluster and the node, so that only the routes
+// created for the cluster are listed, and the node of each route is known.
+type routes struct {
+	client *metal.APIClient
+	vrfID  string
+}
+
+var _ cloudprovider.Routes = (*routes)(nil)
+
+func newRoutes(client *metal.APIClient, vrfID string) *routes {
+	return &routes{
+		client: client,
+		vrfID:  vrfID,
+	}
+}
+
+// ListRoutes lists all managed routes that belong to the specified clusterName
+func (r *routes) ListRoutes(ctx context.Context, clusterName string) ([]*cloudprovider.Route, error) {
+	klog.V(2).Infof("called ListRoutes for cluster %s in VRF %s", clusterName, r.vrfID)
+	vrfRoutes, err := r.clusterRoutes(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*cloudprovider.Route
+	for _, vrfRoute := range vrfRoutes {
+		ret = append(ret, &cloudprovider.Route{
+			Name:            vrfRoute.GetId(),
+			TargetNode:      types.NodeName(routeNodeName(vrfRoute)),
+			DestinationCIDR: vrfRoute.GetPrefix(),
+		})
+	}
+	return ret, nil
+}
+
+// CreateRoute creates a static route in the VRF for the pod CIDR of a node
+func (r *routes) CreateRoute(ctx context.Context, clusterName string, nameHint string, route *cloudprovider.Route) error {
+	klog.V(2).Infof("called CreateRoute for cluster %s node %s CIDR %s in VRF %s", clusterName, route.TargetNode, route.DestinationCIDR, r.vrfID)
+	prefix, err := netip.ParsePrefix(route.DestinationCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid destination CIDR %s for node %s: %w", route.DestinationCIDR, route.TargetNode, err)
+	}
+	nextHop, err := routeNextHop(route.TargetNodeAddresses, prefix.Addr().Is6())
+	if err != nil {
+		return fmt.Errorf("unable to create route for node %s: %w", route.TargetNode, err)
+	}
+
+	req := metal.VrfRouteCreateInput{
+		Prefix:  prefix.Masked().String(),
+		NextHop: nextHop,
+		Tags:    []string{emTag, clusterTag(clusterName), nodeTag(string(route.TargetNode))},
+	}
+	vrfRoute, _, err := r.client.VRFsApi.CreateVrfRoute(ctx, r.vrfID).VrfRouteCreateInput(req).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to create route %s via %s for node %s in VRF %s: %w", req.Prefix, nextHop, route.TargetNode, r.vrfID, err)
+	}
+	klog.Infof("created route %s %s via %s for node %s", vrfRoute.GetId(), req.Prefix, nextHop, route.TargetNode)
+	return nil
+}
+
+// DeleteRoute deletes a static route, as returned by ListRoutes, from the VRF
+func (r *routes) DeleteRoute(ctx context.Context, clusterName string, route *cloudprovider.Route) error {
+	klog.V(2).Infof("called DeleteRoute for cluster %s node %s CIDR %s in VRF %s", clusterName, route.TargetNode, route.DestinationCIDR, r.vrfID)
+	id := route.Name
+	if id == "" {
+		vrfRoutes, err := r.clusterRoutes(ctx, clusterName)
+		if err != nil {
+			return err
+		}
+		for _, vrfRoute := range vrfRoutes {
+			if vrfRoute.GetPrefix() == route.DestinationCIDR && routeNodeName(vrfRoute) == string(route.TargetNode) {
+				id = vrfRoute.GetId()
+				break
+			}
+		}
+		if id == "" {
+			klog.V(2).Infof("no route %s for node %s, nothing to delete", route.DestinationCIDR, route.TargetNode)
+			return nil
+		}
+	}
+
+	_, resp, err := r.client.VRFsApi.DeleteVrfRouteById(ctx, id).Execute()
+	if isNotFound(resp, err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete route %s for node %s: %w", id, route.TargetNode, err)
+	}
+	klog.Infof("deleted route %s %s for node %s", id, route.DestinationCIDR, route.TargetNode)
+	return nil
+}
+
+// clusterRoutes returns the routes in the VRF that were created for the cluster
+func (r *routes) clusterRoutes(ctx context.Context, clusterName string) ([]metal.VrfRoute, error) {
+	page, _, err := r.client.VRFsApi.GetVrfRoutes(ctx, r.vrfID).Execute()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve routes for VRF %s: %w", r.vrfID, err)
+	}
+	// GetVrfRoutes takes no page number, so the pages after the first are reached through their links
+	vrfRoutes := page.GetRoutes()
+	path := fmt.Sprintf("/vrfs/%s/routes", url.PathEscape(r.vrfID))
+	seen := map[string]bool{}
+	for next := nextPage(page.Meta); next != ""; next = nextPage(page.Meta) {
+		if seen[next] {
+			return nil, fmt.Errorf("unable to retrieve routes for VRF %s: page %s was already listed", r.vrfID, next)
+		}
+		seen[next] = true
+		page = &metal.VrfRouteList{}
+		if err := getNextPage(ctx, r.client, path, next, page); err != nil {
+			return nil, fmt.Errorf("unable to retrieve routes for VRF %s: %w", r.vrfID, err)
+		}
+		vrfRoutes = append(vrfRoutes, page.GetRoutes()...)
+	}
+	clsTag := clusterTag(clusterName)
+	var ret []metal.VrfRoute
+	for _, vrfRoute := range vrfRoutes {
+		if slices.Contains(vrfRoute.GetTags(), emTag) && slices.Contains(vrfRoute.GetTags(), clsTag) {
+			ret = append(ret, vrfRoute)
+		}
+	}
+	return ret, nil
+}
+
+// routeNodeName returns the name of the node a route was created for, from its tags
+func routeNodeName(vrfRoute metal.VrfRoute) string {
+	prefix := nodeTag("")
+	for _, tag := range vrfRoute.GetTags() {
+		if name, ok := strings.CutPrefix(tag, prefix); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// routeNextHop returns the first internal address of the given IP family
+func routeNextHop(addresses []v1.NodeAddress, ipv6 bool) (string, error) {
+	for _, address := range addresses {
+		if address.Type != v1.NodeInternalIP {
+			continue
+		}
+		addr, err := netip.ParseAddr(address.Address)
+		if err != nil {
+			continue
+		}
+		if addr.Is6() == ipv6 {
+			return addr.String(), nil
+		}
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	return "", fmt.Errorf("node has no internal %s address to route to", family)
+}
@@ -0,0 +1,88 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+func TestRoutesLifecycle(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	vrfID := "vrf-1"
+	r := newRoutes(vc.client, vrfID)
+	ctx := context.TODO()
+	clusterName := "cluster-1"
+
+	// a route of another cluster, which must not be listed
+	other := &cloudprovider.Route{
+		TargetNode:          "other-node",
+		TargetNodeAddresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.1.0.9"}},
+		DestinationCIDR:     "192.168.9.0/24",
+	}
+	if err := r.CreateRoute(ctx, "cluster-2", "", other); err != nil {
+		t.Fatalf("unexpected error creating route: %v", err)
+	}
+
+	tests := []struct {
+		node      string
+		addresses []v1.NodeAddress
+		cidr      string
+		nextHop   string
+		valid     bool
+	}{
+		{"node-1", []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "147.75.1.1"}, {Type: v1.NodeInternalIP, Address: "10.1.0.1"}}, "192.168.1.0/24", "10.1.0.1", true},
+		{"node-2", []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.1.0.2"}, {Type: v1.NodeInternalIP, Address: "fd00::2"}}, "fd01:0:0:2::/64", "fd00::2", true},
+		{"node-3", []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "147.75.1.3"}}, "192.168.3.0/24", "", false},
+		{"node-4", []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.1.0.4"}}, "not-a-cidr", "", false},
+	}
+	for _, tt := range tests {
+		route := &cloudprovider.Route{
+			TargetNode:          types.NodeName(tt.node),
+			TargetNodeAddresses: tt.addresses,
+			DestinationCIDR:     tt.cidr,
+		}
+		err := r.CreateRoute(ctx, clusterName, "", route)
+		switch {
+		case err != nil && tt.valid:
+			t.Errorf("%s: unexpected error: %v", tt.node, err)
+		case err == nil && !tt.valid:
+			t.Errorf("%s: expected error", tt.node)
+		}
+	}
+
+	// one route per page, so that all of the pages must be walked
+	server.PageSize = 1
+	listed, err := r.ListRoutes(ctx, clusterName)
+	if err != nil {
+		t.Fatalf("unexpected error listing routes: %v", err)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("mismatched routes, actual %d expected %d", len(listed), 2)
+	}
+	for i, route := range listed {
+		tt := tests[i]
+		if string(route.TargetNode) != tt.node || route.DestinationCIDR != tt.cidr {
+			t.Errorf("%d: mismatched route, actual %s %s expected %s %s", i, route.TargetNode, route.DestinationCIDR, tt.node, tt.cidr)
+		}
+		if nextHop := server.VRFRouteStore[vrfID][i+1].GetNextHop(); nextHop != tt.nextHop {
+			t.Errorf("%d: mismatched next hop, actual %s expected %s", i, nextHop, tt.nextHop)
+		}
+	}
+
+	// delete one by name, as listed, and one by node and CIDR
+	if err := r.DeleteRoute(ctx, clusterName, listed[0]); err != nil {
+		t.Errorf("unexpected error deleting route: %v", err)
+	}
+	if err := r.DeleteRoute(ctx, clusterName, &cloudprovider.Route{TargetNode: listed[1].TargetNode, DestinationCIDR: listed[1].DestinationCIDR}); err != nil {
+		t.Errorf("unexpected error deleting route: %v", err)
+	}
+	if listed, err = r.ListRoutes(ctx, clusterName); err != nil || len(listed) != 0 {
+		t.Errorf("mismatched routes after delete, actual %d (%v) expected none", len(listed), err)
+	}
+	if len(server.VRFRouteStore[vrfID]) != 1 {
+		t.Errorf("route of other cluster was deleted")
+	}
+}
@@ -0,0 +1,206 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-provider-equinix-metal/metal/loadbalancers"
+)
+
+const (
+	// spotTerminationResyncPeriod is how often every node is checked again, so that
+	// termination times set on devices are noticed even if their nodes do not change
+	spotTerminationResyncPeriod = 30 * time.Second
+
+	// spotTerminationExcludeValue is the value of the v1.LabelNodeExcludeBalancers label set on the nodes of
+	// terminating spot devices, so that it is removed when the termination is cancelled only if it was set here
+	spotTerminationExcludeValue = "spot-termination"
+
+	eventReasonSpotTermination          = "SpotTermination"
+	eventReasonSpotTerminationCancelled = "SpotTerminationCancelled"
+)
+
+/*
+spotTerminationManager watches the nodes of spot market devices. As the LabelSpotInstance
+label is only set on nodes when they are initialized, all nodes are watched, and the nodes
+of spot devices are found from their devices, which are retrieved again if they are older
+than spotTerminationResyncPeriod. When a device has a termination time, it taints its node
+with loadbalancers.TaintSpotTermination, with both the NoSchedule and NoExecute effects,
+leadTime ahead of that time, and records an Event on the node. The taint drains workloads
+from the node, and load balancers remove tainted nodes from their targets. As the service
+controller only updates load balancers for node label changes, not taint changes, the node
+is also labeled with v1.LabelNodeExcludeBalancers. If the termination time is removed from
+the device, the taints and the label are removed too.
+*/
+type spotTerminationManager struct {
+	k8sclient kubernetes.Interface
+	devices   *deviceCache
+	recorder  record.EventRecorder
+	leadTime  time.Duration
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func newSpotTerminationManager(k8sclient kubernetes.Interface, stop <-chan struct{}, devices *deviceCache, recorder record.EventRecorder, leadTime time.Duration) (*spotTerminationManager, error) {
+	klog.V(2).Info("newSpotTerminationManager()")
+
+	m := &spotTerminationManager{
+		k8sclient: k8sclient,
+		devices:   devices,
+		recorder:  recorder,
+		leadTime:  leadTime,
+		now:       time.Now,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	sharedInformer := informers.NewSharedInformerFactory(k8sclient, spotTerminationResyncPeriod)
+
+	if _, err := sharedInformer.Core().V1().Nodes().Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				n, _ := obj.(*v1.Node)
+				if err := m.reconcileNode(ctx, n); err != nil {
+					klog.Errorf("failed to handle spot termination of node %s: %v", n.Name, err)
+				}
+			},
+			UpdateFunc: func(_, obj interface{}) {
+				n, _ := obj.(*v1.Node)
+				if err := m.reconcileNode(ctx, n); err != nil {
+					klog.Errorf("failed to handle spot termination of node %s: %v", n.Name, err)
+				}
+			},
+		},
+	); err != nil {
+		return m, err
+	}
+
+	sharedInformer.Start(stop)
+	sharedInformer.WaitForCacheSync(stop)
+
+	return m, nil
+}
+
+// terminating returns true if the device is a spot instance that is to be terminated within leadTime
+func (m *spotTerminationManager) terminating(device *metal.Device) bool {
+	if !device.GetSpotInstance() || device.TerminationTime == nil {
+		return false
+	}
+	return !m.now().Before(device.GetTerminationTime().Add(-m.leadTime))
+}
+
+// reconcileNode taints or untaints a node, according to the termination time of its device.
+// Nodes of devices that are not spot instances are never tainted.
+func (m *spotTerminationManager) reconcileNode(ctx context.Context, node *v1.Node) error {
+	if node.Spec.ProviderID == "" {
+		// not initialized yet, so its device is not known
+		return nil
+	}
+	deviceID, err := deviceIDFromProviderID(node.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+	device, err := m.devices.deviceByID(ctx, deviceID)
+	if err == nil && device.GetSpotInstance() {
+		// the termination time must be noticed well within leadTime, whatever the staleness of the cache
+		device, err = m.devices.deviceByIDWithin(ctx, deviceID, spotTerminationResyncPeriod)
+	}
+	if errors.Is(err, cloudprovider.InstanceNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	terminating := m.terminating(device)
+	tainted := loadbalancers.IsTerminating(node)
+	labeled := spotTerminationExcluded(node)
+	if terminating {
+		// a label that was already set excludes the node as well
+		_, labeled = node.Labels[v1.LabelNodeExcludeBalancers]
+	}
+	if terminating == tainted && terminating == labeled {
+		return nil
+	}
+
+	if err := m.setTerminating(ctx, node.Name, terminating); err != nil {
+		return fmt.Errorf("failed to update spot termination taints: %w", err)
+	}
+	if terminating == tainted {
+		// only the label was missing or left behind
+		return nil
+	}
+
+	if terminating {
+		klog.Infof("spot device %s of node %s is to be terminated at %s, tainted node", deviceID, node.Name, device.GetTerminationTime().Format(time.RFC3339))
+		m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonSpotTermination,
+			"Spot market device %s is to be terminated at %s", deviceID, device.GetTerminationTime().Format(time.RFC3339))
+	} else {
+		klog.Infof("spot device %s of node %s is no longer to be terminated, untainted node", deviceID, node.Name)
+		m.recorder.Eventf(node, v1.EventTypeNormal, eventReasonSpotTerminationCancelled,
+			"Spot market device %s is no longer to be terminated", deviceID)
+	}
+	return nil
+}
+
+// spotTerminationExcluded returns true if the node was excluded from load balancers for spot termination
+func spotTerminationExcluded(node *v1.Node) bool {
+	return node.Labels[v1.LabelNodeExcludeBalancers] == spotTerminationExcludeValue
+}
+
+// setTerminating adds or removes the spot termination taints and the label excluding the node from load
+// balancers on the latest version of the node. A label that was not set for spot termination is kept.
+func (m *spotTerminationManager) setTerminating(ctx context.Context, nodeName string, add bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := m.k8sclient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		var taints []v1.Taint
+		for _, taint := range node.Spec.Taints {
+			if taint.Key != loadbalancers.TaintSpotTermination {
+				taints = append(taints, taint)
+			}
+		}
+		if add {
+			now := metav1.NewTime(m.now())
+			taints = append(taints,
+				v1.Taint{Key: loadbalancers.TaintSpotTermination, Effect: v1.TaintEffectNoSchedule, TimeAdded: &now},
+				v1.Taint{Key: loadbalancers.TaintSpotTermination, Effect: v1.TaintEffectNoExecute, TimeAdded: &now},
+			)
+		}
+		node.Spec.Taints = taints
+
+		_, labeled := node.Labels[v1.LabelNodeExcludeBalancers]
+		switch {
+		case add && !labeled:
+			if node.Labels == nil {
+				node.Labels = map[string]string{}
+			}
+			node.Labels[v1.LabelNodeExcludeBalancers] = spotTerminationExcludeValue
+		case !add && spotTerminationExcluded(node):
+			delete(node.Labels, v1.LabelNodeExcludeBalancers)
+		}
+
+		_, err = m.k8sclient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,209 @@
+package metal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	"github.com/google/uuid"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"sigs.k8s.io/cloud-provider-equinix-metal/metal/loadbalancers"
+)
+
+func TestSpotTermination(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	now := time.Now()
+
+	uid := uuid.New().String()
+	devName := testGetNewDevName()
+	dev := &metal.Device{
+		Id:           &uid,
+		Hostname:     &devName,
+		SpotInstance: metal.PtrBool(true),
+	}
+	server.DeviceStore[uid] = dev
+
+	node := testNode(providerIDFromDevice(dev), devName)
+	k8sclient := k8sfake.NewSimpleClientset(node)
+	devices, err := newDeviceCache(vc.client.DevicesApi, Config{ProjectID: vc.config.ProjectID, DeviceCacheMaxStaleness: "0s"})
+	if err != nil {
+		t.Fatalf("unable to create device cache: %v", err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	m := &spotTerminationManager{
+		k8sclient: k8sclient,
+		devices:   devices,
+		recorder:  recorder,
+		leadTime:  10 * time.Minute,
+		now:       func() time.Time { return now },
+	}
+
+	tests := []struct {
+		name            string
+		terminationTime *time.Time
+		tainted         bool
+		event           string
+	}{
+		{"no termination time", nil, false, ""},
+		{"termination after lead time", metal.PtrTime(now.Add(time.Hour)), false, ""},
+		{"termination within lead time", metal.PtrTime(now.Add(5 * time.Minute)), true, eventReasonSpotTermination},
+		{"still terminating", metal.PtrTime(now.Add(5 * time.Minute)), true, ""},
+		{"termination cancelled", nil, false, eventReasonSpotTerminationCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev.TerminationTime = tt.terminationTime
+			current, err := k8sclient.CoreV1().Nodes().Get(context.TODO(), devName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unable to get node: %v", err)
+			}
+			if err := m.reconcileNode(context.TODO(), current); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			updated, err := k8sclient.CoreV1().Nodes().Get(context.TODO(), devName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unable to get node: %v", err)
+			}
+			if tainted := loadbalancers.IsTerminating(updated); tainted != tt.tainted {
+				t.Errorf("mismatched tainted, actual %v expected %v", tainted, tt.tainted)
+			}
+			if tt.tainted && len(updated.Spec.Taints) != 2 {
+				t.Errorf("mismatched taints, actual %v expected NoSchedule and NoExecute", updated.Spec.Taints)
+			}
+			// the label makes the service controller update load balancers, which it does not for taints
+			if excluded := spotTerminationExcluded(updated); excluded != tt.tainted {
+				t.Errorf("mismatched %s label, actual %v expected %v", v1.LabelNodeExcludeBalancers, updated.Labels, tt.tainted)
+			}
+
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if (tt.event == "") != (event == "") || !strings.Contains(event, tt.event) {
+				t.Errorf("mismatched event, actual %q expected reason %q", event, tt.event)
+			}
+		})
+	}
+}
+
+func TestSpotTerminationExcludeLabel(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+	now := time.Now()
+
+	uid := uuid.New().String()
+	devName := testGetNewDevName()
+	dev := &metal.Device{
+		Id:              &uid,
+		Hostname:        &devName,
+		SpotInstance:    metal.PtrBool(true),
+		TerminationTime: metal.PtrTime(now.Add(5 * time.Minute)),
+	}
+	server.DeviceStore[uid] = dev
+
+	// a node already excluded from load balancers by its owner
+	node := testNode(providerIDFromDevice(dev), devName)
+	node.Labels = map[string]string{v1.LabelNodeExcludeBalancers: "true"}
+	k8sclient := k8sfake.NewSimpleClientset(node)
+	devices, err := newDeviceCache(vc.client.DevicesApi, Config{ProjectID: vc.config.ProjectID, DeviceCacheMaxStaleness: "0s"})
+	if err != nil {
+		t.Fatalf("unable to create device cache: %v", err)
+	}
+	m := &spotTerminationManager{
+		k8sclient: k8sclient,
+		devices:   devices,
+		recorder:  record.NewFakeRecorder(10),
+		leadTime:  10 * time.Minute,
+		now:       func() time.Time { return now },
+	}
+
+	// the label is kept both when the node is tainted and when the termination is cancelled
+	for _, terminationTime := range []*time.Time{dev.TerminationTime, nil} {
+		dev.TerminationTime = terminationTime
+		current, err := k8sclient.CoreV1().Nodes().Get(context.TODO(), devName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get node: %v", err)
+		}
+		if err := m.reconcileNode(context.TODO(), current); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		updated, err := k8sclient.CoreV1().Nodes().Get(context.TODO(), devName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get node: %v", err)
+		}
+		if tainted := loadbalancers.IsTerminating(updated); tainted != (terminationTime != nil) {
+			t.Errorf("mismatched tainted, actual %v expected %v", tainted, terminationTime != nil)
+		}
+		if value := updated.Labels[v1.LabelNodeExcludeBalancers]; value != "true" {
+			t.Errorf("mismatched %s label, actual %q expected %q", v1.LabelNodeExcludeBalancers, value, "true")
+		}
+	}
+}
+
+func TestSpotTerminationUnlabeledNode(t *testing.T) {
+	vc, server := testGetValidCloud(t, "")
+
+	// a spot node and another node, neither labeled, as nodes initialized before the label was set are not
+	spot, other := testGetNewDevName(), testGetNewDevName()
+	var nodes []runtime.Object
+	for _, name := range []string{spot, other} {
+		uid := uuid.New().String()
+		dev := &metal.Device{
+			Id:           &uid,
+			Hostname:     metal.PtrString(name),
+			SpotInstance: metal.PtrBool(name == spot),
+			// the termination time of a device that is not a spot instance is ignored
+			TerminationTime: metal.PtrTime(time.Now()),
+		}
+		server.DeviceStore[uid] = dev
+		nodes = append(nodes, testNode(providerIDFromDevice(dev), name))
+	}
+	k8sclient := k8sfake.NewSimpleClientset(nodes...)
+	devices, err := newDeviceCache(vc.client.DevicesApi, vc.config)
+	if err != nil {
+		t.Fatalf("unable to create device cache: %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if _, err := newSpotTerminationManager(k8sclient, stop, devices, record.NewFakeRecorder(10), 10*time.Minute); err != nil {
+		t.Fatalf("unable to create spot termination manager: %v", err)
+	}
+
+	err = wait.PollUntilContextTimeout(context.TODO(), 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		node, err := k8sclient.CoreV1().Nodes().Get(ctx, spot, metav1.GetOptions{})
+		return err == nil && loadbalancers.IsTerminating(node), err
+	})
+	if err != nil {
+		t.Errorf("spot node %s not tainted: %v", spot, err)
+	}
+	node, err := k8sclient.CoreV1().Nodes().Get(context.TODO(), other, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get node: %v", err)
+	}
+	if loadbalancers.IsTerminating(node) {
+		t.Errorf("node %s of a device that is not a spot instance tainted", other)
+	}
+}
+
+func TestFilterNodesTerminating(t *testing.T) {
+	running := testNode("", "running")
+	terminating := testNode("", "terminating")
+	terminating.Spec.Taints = []v1.Taint{{Key: loadbalancers.TaintSpotTermination, Effect: v1.TaintEffectNoExecute}}
+
+	filtered := filterNodes([]*v1.Node{running, terminating}, labels.Everything())
+	if len(filtered) != 1 || filtered[0] != running {
+		t.Errorf("mismatched nodes, actual %v expected only %s", filtered, running.Name)
+	}
+}
@@ -2,10 +2,14 @@ package testing
 
 import (
 	"encoding/json"
+	"fmt"
+	"math/bits"
 	"net/http"
+	"strconv"
 	"testing"
 
 	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
@@ -15,6 +19,10 @@ type MockMetalServer struct {
 		Devices    []*metal.Device
 		BgpEnabled bool
 	}
+	IPReservationStore map[string]*metal.IPReservationList
+	VRFRouteStore      map[string][]*metal.VrfRoute
+	// PageSize, if set, is the number of IP reservations and VRF routes listed per page
+	PageSize int
 
 	T *testing.T
 }
@@ -26,7 +34,9 @@ func NewMockMetalServer(t *testing.T) *MockMetalServer {
 			Devices    []*metal.Device
 			BgpEnabled bool
 		}{},
-		T: t,
+		IPReservationStore: map[string]*metal.IPReservationList{},
+		VRFRouteStore:      map[string][]*metal.VrfRoute{},
+		T:                  t,
 	}
 }
 
@@ -38,10 +48,36 @@ func (s *MockMetalServer) CreateHandler() http.Handler {
 	r.HandleFunc("/projects/{projectID}/devices", s.listDevicesHandler).Methods("GET")
 	// get a single device
 	r.HandleFunc("/devices/{deviceID}", s.getDeviceHandler).Methods("GET")
+	// get all IP reservations for a project
+	r.HandleFunc("/projects/{projectID}/ips", s.listIPReservationsHandler).Methods("GET")
+	r.HandleFunc("/projects/{projectID}/ips", s.requestIPReservationHandler).Methods("POST")
+	// update and delete a single IP reservation
+	r.HandleFunc("/ips/{id}", s.updateIPReservationHandler).Methods("PATCH")
+	r.HandleFunc("/ips/{id}", s.deleteIPReservationHandler).Methods("DELETE")
+	// list, create and delete VRF routes
+	r.HandleFunc("/vrfs/{vrfID}/routes", s.listVRFRoutesHandler).Methods("GET")
+	r.HandleFunc("/vrfs/{vrfID}/routes", s.createVRFRouteHandler).Methods("POST")
+	r.HandleFunc("/routes/{routeID}", s.deleteVRFRouteHandler).Methods("DELETE")
 	// handle metadata requests
 	return r
 }
 
+// page returns the range of the items of a list of count that are on the page of the request, and its meta,
+// which links to the next page with the path prefix of the server URL, as the API does
+func (s *MockMetalServer) page(r *http.Request, count int) (start, end int, meta *metal.Meta) {
+	page := 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 1 {
+		page = p
+	}
+	start = min((page-1)*s.PageSize, count)
+	end = min(start+s.PageSize, count)
+	meta = &metal.Meta{Total: metal.PtrInt32(int32(count)), CurrentPage: metal.PtrInt32(int32(page))}
+	if end < count {
+		meta.Next = &metal.Href{Href: fmt.Sprintf("/metal/v1%s?page=%d&per_page=%d", r.URL.Path, page+1, s.PageSize)}
+	}
+	return start, end, meta
+}
+
 func (s *MockMetalServer) listDevicesHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectID := vars["projectID"]
@@ -60,6 +96,165 @@ func (s *MockMetalServer) listDevicesHandler(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+func (s *MockMetalServer) listIPReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectID"]
+
+	resp := s.IPReservationStore[projectID]
+	if resp == nil {
+		resp = &metal.IPReservationList{IpAddresses: []metal.IPReservationListIpAddressesInner{}}
+	}
+	if s.PageSize > 0 {
+		start, end, meta := s.page(r, len(resp.IpAddresses))
+		resp = &metal.IPReservationList{IpAddresses: resp.IpAddresses[start:end], Meta: meta}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.T.Fatal(err.Error())
+	}
+}
+
+// requestIPReservationHandler reserves a new block of the requested quantity, numbered after the existing ones
+func (s *MockMetalServer) requestIPReservationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectID"]
+	var req metal.IPReservationRequestInput
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	list := s.IPReservationStore[projectID]
+	if list == nil {
+		list = &metal.IPReservationList{}
+		s.IPReservationStore[projectID] = list
+	}
+	cidr := int32(32 - bits.Len32(uint32(req.Quantity)-1))
+	address := fmt.Sprintf("147.75.%d.0", len(list.IpAddresses)+1)
+	reservation := &metal.IPReservation{
+		Id:      metal.PtrString(uuid.New().String()),
+		Address: &address,
+		Network: &address,
+		Cidr:    &cidr,
+		Tags:    req.Tags,
+	}
+	if req.Metro != nil {
+		reservation.Metro = &metal.IPReservationMetro{Code: req.Metro}
+	}
+	if req.Facility != nil {
+		reservation.Facility = &metal.IPReservationFacility{Code: req.Facility}
+	}
+	list.IpAddresses = append(list.IpAddresses, metal.IPReservationListIpAddressesInner{IPReservation: reservation})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(reservation); err != nil {
+		s.T.Fatal(err.Error())
+	}
+}
+
+func (s *MockMetalServer) updateIPReservationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var req metal.IPAssignmentUpdateInput
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, list := range s.IPReservationStore {
+		for _, ip := range list.IpAddresses {
+			if ip.IPReservation != nil && ip.IPReservation.GetId() == vars["id"] {
+				if req.Tags != nil {
+					ip.IPReservation.Tags = req.Tags
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(ip.IPReservation); err != nil {
+					s.T.Fatal(err.Error())
+				}
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *MockMetalServer) deleteIPReservationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	for _, list := range s.IPReservationStore {
+		for i, ip := range list.IpAddresses {
+			if ip.IPReservation != nil && ip.IPReservation.GetId() == vars["id"] {
+				list.IpAddresses = append(list.IpAddresses[:i], list.IpAddresses[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *MockMetalServer) listVRFRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	routes := s.VRFRouteStore[vars["vrfID"]]
+	var resp = struct {
+		Routes []*metal.VrfRoute `json:"routes"`
+		Meta   *metal.Meta       `json:"meta,omitempty"`
+	}{
+		Routes: routes,
+	}
+	if s.PageSize > 0 {
+		start, end, meta := s.page(r, len(routes))
+		resp.Routes, resp.Meta = routes[start:end], meta
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		s.T.Fatal(err.Error())
+	}
+}
+
+func (s *MockMetalServer) createVRFRouteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vrfID := vars["vrfID"]
+	var req metal.VrfRouteCreateInput
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	route := &metal.VrfRoute{
+		Id:      metal.PtrString(uuid.New().String()),
+		Prefix:  metal.PtrString(req.Prefix),
+		NextHop: metal.PtrString(req.NextHop),
+		Tags:    req.Tags,
+	}
+	s.VRFRouteStore[vrfID] = append(s.VRFRouteStore[vrfID], route)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(route); err != nil {
+		s.T.Fatal(err.Error())
+	}
+}
+
+func (s *MockMetalServer) deleteVRFRouteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	routeID := vars["routeID"]
+	for vrfID, routes := range s.VRFRouteStore {
+		for i, route := range routes {
+			if route.GetId() != routeID {
+				continue
+			}
+			s.VRFRouteStore[vrfID] = append(routes[:i], routes[i+1:]...)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(route); err != nil {
+				s.T.Fatal(err.Error())
+			}
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
 // get information about a specific device
 func (s *MockMetalServer) getDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)